@@ -7,33 +7,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/echa/btcutil/hash"
-	"github.com/echa/btcutil/log"
-	"github.com/echa/btcutil/rpc"
-	"github.com/echa/btcutil/txscript"
-	"github.com/echa/btcutil/wire"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btclog"
+	"github.com/btcsuite/websocket"
+	"github.com/lightninglabs/gozmq"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
-	jrpcLog     = log.NewLogger("JRPC")
+	log         = logging.New("HTLC")
+	jrpcLog     = logging.New("JRPC")
 	flags       = flag.NewFlagSet("index", flag.ContinueOnError)
 	height      int64
 	chain       string
@@ -43,80 +63,5025 @@ var (
 	pass        string
 	verbose     bool
 	concurrency int
+	dataDir     string
+	bare        bool
+	fromFlag    string
+	toFlag      string
+	forward     bool
+	workers     int
+	chunkSize   int64
+	chainsFile  string
+	followFlag  bool
+	pollFlag    time.Duration
+	depthFlag   int
+	zmqFlag     string
+	wsFlag      bool
+	mempoolFlag bool
+	cacheSize   int
+	rulesFile   string
+	enableFlag  string
+	esploraURL  string
+	retries     int
+	rawFlag     string
+	certFile    string
+	// the detection rules read from rulesFile
+	rules       []*rule
+	// leaf version of tapscript, elements chains use their own
+	leafVersion = txscript.BaseLeafVersion
+	// elements states the fee in outputs without script instead of leaving it to the inputs
+	feeOutputs  bool
+	// the first opcodes of the scriptSig of inputs which spend no output (see registry.Chain.PoolSpends)
+	poolSpends  map[byte]bool
+)
+
+func init() {
+	flags.Usage = func() {}
+	flags.Int64Var(&height, "height", 0, "start height (same as -to, or -from with -forward)")
+	flags.StringVar(&fromFlag, "from", "", "lowest block to scan, a height or a date (2006-01-02 or RFC 3339)")
+	flags.StringVar(&toFlag, "to", "", "highest block to scan, a height or a date (default: best block)")
+	flags.BoolVar(&forward, "forward", false, "scan from -from up to -to instead of backwards")
+	flags.IntVar(&workers, "workers", 1, "number of block ranges scanned in parallel")
+	flags.Int64Var(&chunkSize, "chunk", 1000, "number of blocks per range")
+	flags.BoolVar(&followFlag, "follow", false, "keep processing new blocks after the range is scanned")
+	flags.DurationVar(&pollFlag, "poll", 30*time.Second, "interval to check for new blocks with -follow")
+	flags.IntVar(&depthFlag, "depth", 100, "number of followed blocks kept to detect reorganisations")
+	flags.StringVar(&zmqFlag, "zmq", "", "zmqpubhashblock or zmqpubrawblock endpoint of the node (e.g. tcp://127.0.0.1:28332) to learn about new blocks with -follow")
+	flags.BoolVar(&wsFlag, "ws", false, "learn about new blocks with -follow from the websocket notifications of dcrd")
+	flags.BoolVar(&mempoolFlag, "mempool", false, "look for HTLCs in unconfirmed transactions with -follow, announced by -zmq or polled")
+	flags.StringVar(&chain, "chain", "bitcoin", "blockchain, a name or alias from the chain registry")
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
+	flags.StringVar(&rulesFile, "rules", "rules.json", "detection rules")
+	flags.StringVar(&enableFlag, "enable", "", "comma separated names of disabled detection rules to use, e.g. hashlock-multisig")
+	flags.StringVar(&host, "host", "127.0.0.1", "RPC hostname")
+	flags.StringVar(&user, "user", "", "RPC username")
+	flags.StringVar(&pass, "pass", "", "RPC password")
+	flags.StringVar(&port, "port", "", "RPC port")
+	flags.StringVar(&certFile, "cert", "", "certificate of the node for RPC over TLS (default: the one in the chain registry, e.g. rpc.cert for dcrd)")
+	flags.IntVar(&concurrency, "c", 1, "RPC Concurrency")
+	flags.BoolVar(&verbose, "v", false, "be verbose")
+	flags.StringVar(&dataDir, "datadir", "", "read the block files of a stopped node in this data directory instead of using RPC")
+	flags.IntVar(&cacheSize, "cache", 1000000, "number of outputs kept to know the spent outputs of later blocks without a txindex (0 to disable)")
+	flags.StringVar(&esploraURL, "esplora", "", "read the blockchain from the HTTP API of an Esplora indexer at this URL (e.g. http://127.0.0.1:3000) instead of using RPC")
+	flags.IntVar(&retries, "retries", 5, "number of retries of failed Esplora requests and of blocks which could not be fetched over RPC")
+	flags.StringVar(&rawFlag, "raw", "", "request serialized blocks with getblock (rpc) or from the REST interface of the node (rest) and decode them locally, the spent outputs are then fetched per input or taken from the cache")
+	flags.BoolVar(&bare, "bare", false, "look for bare HTLCs in spent outputs, which needs an RPC per input unless the spent outputs are known (e.g. with -datadir)")
+	rpcclient.UseLogger(jrpcLog)
+}
+
+type candidate struct {
+	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
+	Timestamp   string   `json:"timestamp"`
+	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	// fee of the transaction in coins and its virtual size (the size for chains without segwit)
+	// nil if the spent outputs of the transaction are not known without asking the node
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	// expiry height of the transaction (decred, zcash) and its tree (decred, 0 regular, 1 stake)
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
+	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
+	InputValue  float64  `json:"input_value"`
+	// elements only: the asset id of the spent output, empty if blinded, and whether its value is blinded
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	// scriptPubKey of the spent output
+	PrevScript  string   `json:"prev_script"`
+	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
+	// the detection rules matched by the script and the family of the first one
+	Rules       []string `json:"rules,omitempty"`
+	Family      string   `json:"family"`
+	// the input spends the refund path of the script
+	Refund      bool     `json:"refund,omitempty"`
+	// the outpoint (txid:vout) of the funding output a refund returns
+	Funding     string   `json:"funding,omitempty"`
+	// the script belongs to a lightning channel (offered-htlc, received-htlc, to-local or anchor)
+	Lightning   string   `json:"lightning,omitempty"`
+	// the transaction is not mined yet, Block is 0 and Timestamp is the time it was seen
+	Unconfirmed bool     `json:"unconfirmed,omitempty"`
+}
+
+// block is the chain independent representation of a block which is handed to the HTLC detection.
+type block struct {
+	Hash         string
+	Height       int64
+	Time         int64
+	Size         int32
+	PreviousHash string
+	NextHash     string
+	Tx           []*transaction
+}
+
+type transaction struct {
+	Txid     string
+	Version  int32
+	LockTime uint32
+	// virtual size, for transactions without witness the size
+	VSize    int64
+	Vin      []*txIn
+	Vout     []*txOut
+	// decred and zcash: the height after which the transaction can not be mined,
+	// decred only: the tree it is in (0 regular, 1 stake)
+	Expiry   uint32
+	Tree     int8
+	// zcash only: the value balances of sapling and orchard and the sums of vpub_old and vpub_new of the
+	// joinsplits, which move value between the transparent part and the shielded pools
+	ValueBalanceSapling int64
+	ValueBalanceOrchard int64
+	VPubOld             int64
+	VPubNew             int64
+}
+
+type txIn struct {
+	// also set for inputs which spend no output of this chain (decred stakebase, elements peg-in)
+	Coinbase  bool
+	Txid      string
+	Vout      uint32
+	ScriptSig []byte
+	Witness   [][]byte
+	Sequence  uint32
+	// the spent output if the source already knows it (e.g. from undo data)
+	PrevOut   *txOut
+}
+
+type txOut struct {
+	Value    int64
+	PkScript []byte
+	// script version (decred), 0 everywhere else
+	Version  uint16
+	// elements only: the asset id, empty if it is blinded, and whether the value is blinded (Value is 0)
+	Asset    string
+	Blinded  bool
+}
+
+// blockSource is the backend the detector reads the blockchain from.
+// Blocks can be fetched by hash, the hash of a block by its height.
+// BlockHeader returns a block without transactions, which is cheaper if only its time or height is needed.
+// Single transactions and the outputs spent by an input are needed to get the value of a found HTLC.
+type blockSource interface {
+	BestHeight(ctx context.Context) (int64, error)
+	BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error)
+	BlockHeader(ctx context.Context, h *chainhash.Hash) (*block, error)
+	Block(ctx context.Context, h *chainhash.Hash) (*block, error)
+	Transaction(ctx context.Context, txid *chainhash.Hash) (*transaction, error)
+	PrevOut(ctx context.Context, in *txIn) (*txOut, error)
+	Mempool(ctx context.Context) ([]*chainhash.Hash, error)
+}
+
+// rpcSource is a blockSource talking JSON-RPC to a bitcoind compatible node (bitcoind, litecoind, bitcoin-abc or dcrd).
+type rpcSource struct {
+	c           *rpcclient.Client
+	decred      bool
+	concurrency int
+	retries     int
+	// false if the node does not support getblock with verbosity 2
+	verboseTx   bool
+	// getblock takes verbose true or false instead of a verbosity (see registry.RPC.GetBlock)
+	boolVerbose bool
+	mu          sync.Mutex
+	// how serialized blocks are requested (rpc or rest), empty to request json
+	raw         string
+	// serialization of the blocks (see registry.Chain.Wire)
+	wire        string
+	// base url and client of the REST interface of the node
+	restURL     string
+	rest        *http.Client
+	// delay before the first retry of a failed request
+	delay       time.Duration
+	// client sending its requests together in one batch, batchMu is held while the batch is built
+	batch       *rpcclient.Client
+	batchMu     sync.Mutex
+}
+
+func newRPCSource(config *rpcclient.ConnConfig, decred bool, concurrency, retries int, raw, wire string, boolVerbose bool) (*rpcSource, error) {
+	c, err := rpcclient.New(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := rpcclient.NewBatch(config)
+	if err != nil {
+		return nil, err
+	}
+	
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	
+	scheme := "https"
+	if config.DisableTLS {
+		scheme = "http"
+	}
+	
+	return &rpcSource{
+		c: c,
+		decred: decred,
+		concurrency: concurrency,
+		retries: retries,
+		verboseTx: !boolVerbose,
+		boolVerbose: boolVerbose,
+		raw: raw,
+		wire: wire,
+		restURL: scheme + "://" + config.Host + "/rest",
+		rest: &http.Client{Timeout: time.Minute},
+		delay: time.Second,
+		batch: batch,
+	}, nil
+}
+
+// request sends a raw JSON-RPC request and unmarshals the result into v. It returns when ctx is done,
+// the result of the request is dropped then.
+func (s *rpcSource) request(ctx context.Context, method string, params []interface{}, v interface{}) error {
+	rawParams := make([]json.RawMessage, len(params))
+	for i, param := range params {
+		raw, err := json.Marshal(param)
+		if err != nil {
+			return err
+		}
+		rawParams[i] = raw
+	}
+	
+	type result struct {
+		res json.RawMessage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := s.c.RawRequest(method, rawParams)
+		done <- result{res, err}
+	}()
+	
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		
+		return json.Unmarshal(r.res, v)
+	}
+}
+
+// requestRetry sends a request like request and retries it with an increasing delay
+// if it failed for another reason than an error returned by the node
+func (s *rpcSource) requestRetry(ctx context.Context, method string, params []interface{}, v interface{}) error {
+	return s.retry(ctx, method, func() error {
+		return s.request(ctx, method, params, v)
+	})
+}
+
+// restError is the status of a failed request to the REST interface
+type restError struct {
+	Code   int
+	Status string
+}
+
+func (e *restError) Error() string {
+	return "rest: " + e.Status
+}
+
+// retry calls f until it succeeds, the node returns an error or the retries are used up,
+// the delay between the tries doubles each time. Like esplora, the REST interface is asked again
+// after a server error or 429 (too many requests).
+func (s *rpcSource) retry(ctx context.Context, what string, f func() error) error {
+	delay := s.delay
+	
+	for try := 0; ; try++ {
+		err := f()
+		switch err := err.(type) {
+		case *btcjson.RPCError:
+			return err
+		case *restError:
+			if err.Code != http.StatusTooManyRequests && err.Code < 500 {
+				return err
+			}
+		}
+		if err == nil || ctx.Err() != nil || try >= s.retries {
+			return err
+		}
+		
+		log.Debugf("%s: %v, retrying in %v\n", what, err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// verbosity returns the parameter of getblock for the given verbosity, nodes with verbose true or false
+// only know 0 and 1
+func (s *rpcSource) verbosity(level int) interface{} {
+	if s.boolVerbose {
+		return level > 0
+	}
+	
+	return level
+}
+
+// unsupportedParams tells whether the node rejected the parameters of a request, e.g. a verbosity
+// it does not know
+func unsupportedParams(err error) bool {
+	if rpcErr, ok := err.(*btcjson.RPCError); ok {
+		switch rpcErr.Code {
+		case btcjson.ErrRPCInvalidParameter, btcjson.ErrRPCType, btcjson.ErrRPCInvalidParams.Code, btcjson.ErrRPCMethodNotFound.Code:
+			return true
+		}
+	}
+	
+	return false
+}
+
+func (s *rpcSource) BestHeight(ctx context.Context) (int64, error) {
+	var height int64
+	err := s.request(ctx, "getblockcount", nil, &height)
+	
+	return height, err
+}
+
+func (s *rpcSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	var hash string
+	if err := s.request(ctx, "getblockhash", []interface{}{height}, &hash); err != nil {
+		return nil, err
+	}
+	
+	return chainhash.NewHashFromStr(hash)
+}
+
+func (s *rpcSource) BlockHeader(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	// the fields used here are the same for dcrd
+	var res btcjson.GetBlockHeaderVerboseResult
+	if err := s.request(ctx, "getblockheader", []interface{}{h.String(), true}, &res); err != nil {
+		return nil, err
+	}
+	
+	return &block{
+		Hash: res.Hash,
+		Height: int64(res.Height),
+		Time: res.Time,
+		PreviousHash: res.PreviousHash,
+		NextHash: res.NextHash,
+	}, nil
+}
+
+func (s *rpcSource) Block(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	// decode the serialized block, blocks which can not be decoded (e.g. with MWEB data) are requested as json
+	if s.raw != "" && s.wire != "" {
+		b, err := s.rawBlock(ctx, h)
+		if err == nil {
+			return b, nil
+		}
+		log.Debugf("decoding block %s failed, requesting json: %v\n", h, err)
+	}
+	
+	if s.decred {
+		return s.decredBlock(ctx, h)
+	}
+	
+	s.mu.Lock()
+	verboseTx := s.verboseTx
+	s.mu.Unlock()
+	
+	if verboseTx {
+		// verbosity 3 adds the spent outputs, older nodes treat it like 2
+		params := []interface{}{h.String(), 3}
+		
+		var raw json.RawMessage
+		err := s.requestRetry(ctx, "getblock", params, &raw)
+		switch {
+		case err == nil:
+			b, err := s.verboseBlock(raw)
+			if err == nil {
+				return b, nil
+			}
+			// only this block falls back to single transactions
+			log.Debugf("decoding getblock %s with transactions failed, requesting single transactions: %v\n", h, err)
+		case unsupportedParams(err):
+			// the node does not know verbosity 2, so fetch the transactions one by one from now on
+			s.mu.Lock()
+			if s.verboseTx {
+				log.Infof("getblock with transactions is not supported, falling back to single transactions: %v", err)
+				s.verboseTx = false
+			}
+			s.mu.Unlock()
+		default:
+			// other errors (e.g. timeouts) do not change how blocks are requested
+			return nil, err
+		}
+	}
+	
+	var res btcjson.GetBlockVerboseResult
+	if err := s.requestRetry(ctx, "getblock", []interface{}{h.String(), s.verbosity(1)}, &res); err != nil {
+		return nil, err
+	}
+	
+	b := &block{
+		Hash: res.Hash,
+		Height: res.Height,
+		Time: res.Time,
+		Size: res.Size,
+		PreviousHash: res.PreviousHash,
+		NextHash: res.NextHash,
+		Tx: make([]*transaction, len(res.Tx)),
+	}
+	
+	// fetch all tx in parallel
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	jobs := make(chan int)
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				txid, err := chainhash.NewHashFromStr(res.Tx[i])
+				if err == nil {
+					b.Tx[i], err = s.Transaction(ctx, txid)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range res.Tx {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	
+	if firstErr != nil {
+		return nil, fmt.Errorf("error getting txs in block %d: %v", res.Height, firstErr)
+	}
+	
+	return b, nil
+}
+
+// verboseBlock converts the result of getblock with verbosity 2 or 3
+func (s *rpcSource) verboseBlock(raw json.RawMessage) (*block, error) {
+	var (
+		res      btcjson.GetBlockVerboseTxResult
+		prevOuts blockPrevOuts
+		elements elementsBlock
+		zcash    zcashBlock
+	)
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &prevOuts); err != nil {
+		return nil, err
+	}
+	if s.wire == "elements" {
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			return nil, err
+		}
+	}
+	if s.wire == "zcash" {
+		if err := json.Unmarshal(raw, &zcash); err != nil {
+			return nil, err
+		}
+	}
+	
+	b := &block{
+		Hash: res.Hash,
+		Height: res.Height,
+		Time: res.Time,
+		Size: res.Size,
+		PreviousHash: res.PreviousHash,
+		NextHash: res.NextHash,
+	}
+	
+	for i := range res.Tx {
+		tx, err := newTransaction(&res.Tx[i])
+		if err != nil {
+			return nil, err
+		}
+		if i < len(prevOuts.Tx) {
+			if err := prevOuts.Tx[i].set(tx); err != nil {
+				return nil, err
+			}
+		}
+		if i < len(elements.Tx) {
+			elements.Tx[i].set(tx)
+		}
+		if i < len(zcash.Tx) {
+			zcash.Tx[i].set(tx)
+		}
+		b.Tx = append(b.Tx, tx)
+	}
+	
+	return b, nil
+}
+
+// restGet fetches url from the REST interface of the node
+func (s *rpcSource) restGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	res, err := s.rest.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	
+	if res.StatusCode != http.StatusOK {
+		return nil, &restError{res.StatusCode, res.Status}
+	}
+	
+	return ioutil.ReadAll(res.Body)
+}
+
+// rawBlock requests the serialized block with getblock verbosity 0 or from the REST interface
+// and decodes it. The spent outputs are not known.
+func (s *rpcSource) rawBlock(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	var raw []byte
+	
+	if s.raw == "rest" {
+		url := s.restURL + "/block/" + h.String() + ".bin"
+		err := s.retry(ctx, url, func() error {
+			var err error
+			raw, err = s.restGet(ctx, url)
+			
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var rawHex string
+		if err := s.requestRetry(ctx, "getblock", []interface{}{h.String(), s.verbosity(0)}, &rawHex); err != nil {
+			return nil, err
+		}
+		
+		var err error
+		if raw, err = hex.DecodeString(rawHex); err != nil {
+			return nil, err
+		}
+	}
+	
+	b, err := decodeBlock(s.wire, raw)
+	if err != nil {
+		return nil, err
+	}
+	b.Hash = h.String()
+	b.Size = int32(len(raw))
+	
+	// the serialized block neither knows its height nor the next block
+	if !missingTxids(b) {
+		var header btcjson.GetBlockHeaderVerboseResult
+		if err := s.requestRetry(ctx, "getblockheader", []interface{}{h.String(), true}, &header); err != nil {
+			return nil, err
+		}
+		b.Height = int64(header.Height)
+		b.NextHash = header.NextHash
+		
+		return b, nil
+	}
+	
+	// and the txids of zcash v5 transactions are not the hash of the serialized transaction
+	var res struct {
+		Height   int64    `json:"height"`
+		NextHash string   `json:"nextblockhash"`
+		Tx       []string `json:"tx"`
+	}
+	if err := s.requestRetry(ctx, "getblock", []interface{}{h.String(), s.verbosity(1)}, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Tx) != len(b.Tx) {
+		return nil, fmt.Errorf("%d transactions decoded, the node knows %d", len(b.Tx), len(res.Tx))
+	}
+	
+	b.Height = res.Height
+	b.NextHash = res.NextHash
+	for i, tx := range b.Tx {
+		if tx.Txid != "" && tx.Txid != res.Tx[i] {
+			return nil, fmt.Errorf("transaction %d decoded as %s, the node knows %s", i, tx.Txid, res.Tx[i])
+		}
+		tx.Txid = res.Tx[i]
+	}
+	
+	return b, nil
+}
+
+// missingTxids tells whether the txid of a transaction of the block could not be computed
+func missingTxids(b *block) bool {
+	for _, tx := range b.Tx {
+		if tx.Txid == "" {
+			return true
+		}
+	}
+	
+	return false
+}
+
+// auxPowVersion is the flag in the version of merge mined blocks (auxpow.h of namecoin and dogecoin)
+const auxPowVersion = 1 << 8
+
+// decodeAuxPowBlock decodes a block of a merge mined chain like dogecoin. The header of a merge mined block
+// is followed by the proof of work of the parent chain: the coinbase of the parent block with its merkle branch,
+// the merkle branch of the merge mined chains and the header of the parent block. The proof is not checked.
+func decodeAuxPowBlock(raw []byte) (*block, error) {
+	r := bytes.NewReader(raw)
+	
+	var header wire.BlockHeader
+	if err := header.Deserialize(r); err != nil {
+		return nil, err
+	}
+	
+	if header.Version&auxPowVersion != 0 {
+		var coinbase wire.MsgTx
+		if err := coinbase.DeserializeNoWitness(r); err != nil {
+			return nil, fmt.Errorf("auxpow coinbase: %v", err)
+		}
+		
+		// the parent block hash (unused) and the two merkle branches with the index in them
+		if _, err := r.Seek(chainhash.HashSize, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		for i := 0; i < 2; i++ {
+			count, err := wire.ReadVarInt(r, 0)
+			if err != nil {
+				return nil, err
+			}
+			if count > uint64(r.Len() / chainhash.HashSize) {
+				return nil, fmt.Errorf("auxpow merkle branch with %d hashes", count)
+			}
+			if _, err := r.Seek(int64(count) * chainhash.HashSize + 4, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		
+		var parent wire.BlockHeader
+		if err := parent.Deserialize(r); err != nil {
+			return nil, fmt.Errorf("auxpow parent header: %v", err)
+		}
+	}
+	
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("block with %d transactions", count)
+	}
+	
+	b := &block{
+		Time: header.Timestamp.Unix(),
+		PreviousHash: header.PrevBlock.String(),
+	}
+	for i := uint64(0); i < count; i++ {
+		msgTx := new(wire.MsgTx)
+		if err := msgTx.Deserialize(r); err != nil {
+			return nil, err
+		}
+		b.Tx = append(b.Tx, newTransactionFromWire(msgTx))
+	}
+	
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after the transactions", r.Len())
+	}
+	
+	return b, nil
+}
+
+// decodeBlock decodes a serialized block of the given format (see registry.Chain.Wire).
+// The hash, height, size and next block are left to the caller.
+func decodeBlock(format string, raw []byte) (*block, error) {
+	switch format {
+	case "bitcoin":
+		var msgBlock wire.MsgBlock
+		if err := msgBlock.Deserialize(bytes.NewReader(raw)); err != nil {
+			return nil, err
+		}
+		
+		// litecoin appends the MWEB data to the transactions
+		if msgBlock.SerializeSize() != len(raw) {
+			return nil, fmt.Errorf("%d bytes after the transactions", len(raw) - msgBlock.SerializeSize())
+		}
+		
+		b := &block{
+			Time: msgBlock.Header.Timestamp.Unix(),
+			PreviousHash: msgBlock.Header.PrevBlock.String(),
+		}
+		for _, msgTx := range msgBlock.Transactions {
+			b.Tx = append(b.Tx, newTransactionFromWire(msgTx))
+		}
+		
+		return b, nil
+	case "auxpow":
+		return decodeAuxPowBlock(raw)
+	case "zcash":
+		return decodeZcashBlock(raw)
+	case "elements":
+		return decodeElementsBlock(raw)
+	default:
+		return nil, fmt.Errorf("unknown block format %q", format)
+	}
+}
+
+// decodeTx decodes a serialized transaction of the given format (see registry.Chain.Wire), e.g. one announced
+// by the node. The txid of zcash transactions since v5 is left to the caller.
+func decodeTx(format string, raw []byte) (*transaction, error) {
+	var (
+		tx  *transaction
+		r   = bytes.NewReader(raw)
+		err error
+	)
+	
+	switch format {
+	case "bitcoin", "auxpow":
+		msgTx := new(wire.MsgTx)
+		if err := msgTx.Deserialize(r); err != nil {
+			return nil, err
+		}
+		tx = newTransactionFromWire(msgTx)
+	case "zcash":
+		if tx, err = readZcashTx(r); err != nil {
+			return nil, err
+		}
+		tx.VSize = int64(len(raw))
+		if tx.Version < 5 {
+			tx.Txid = chainhash.DoubleHashH(raw).String()
+		}
+	case "elements":
+		if tx, err = readElementsTx(raw, r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown transaction format %q", format)
+	}
+	
+	// e.g. the MWEB part of a litecoin transaction
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after the transaction", r.Len())
+	}
+	
+	return tx, nil
+}
+
+// sizes of the shielded parts of zcash transactions (https://zips.z.cash/protocol/protocol.pdf, 7.1),
+// they are skipped except for the values as only the transparent inputs and outputs can spend an HTLC
+const (
+	zcashHeaderSize     = 140
+	zcashJoinSplitSize  = 1802
+	zcashJoinSplitGroth = 1698
+	zcashSpendSize      = 384
+	zcashOutputSize     = 948
+	zcashSpendV5Size    = 96
+	zcashOutputV5Size   = 756
+	zcashActionSize     = 820
+	zcashProofSize      = 192
+	zcashSignatureSize  = 64
 )
 
-func init() {
-	flags.Usage = func() {}
-	flags.Int64Var(&height, "height", 0, "start height")
-	flags.StringVar(&chain, "chain", "bitcoin", "blockchain")
-	flags.StringVar(&host, "host", "127.0.0.1", "RPC hostname")
-	flags.StringVar(&user, "user", "", "RPC username")
-	flags.StringVar(&pass, "pass", "", "RPC password")
-	flags.StringVar(&port, "port", "", "RPC port")
-	flags.IntVar(&concurrency, "c", 1, "RPC Concurrency")
-	flags.BoolVar(&verbose, "v", false, "be verbose")
-	rpc.UseLogger(jrpcLog)
+// decodeZcashBlock decodes a block of zcash or one of its forks (e.g. komodo). The header has a
+// commitment and an equihash solution after the fields of bitcoin, the transactions have the formats
+// of sprout (v1, v2), overwinter (v3), sapling (v4) and NU5 (v5).
+func decodeZcashBlock(raw []byte) (*block, error) {
+	if len(raw) < zcashHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	
+	var prevHash chainhash.Hash
+	copy(prevHash[:], raw[4:36])
+	
+	b := &block{
+		Time: int64(binary.LittleEndian.Uint32(raw[100:104])),
+		PreviousHash: prevHash.String(),
+	}
+	
+	r := bytes.NewReader(raw[zcashHeaderSize:])
+	if _, err := wire.ReadVarBytes(r, 0, uint32(len(raw)), "solution"); err != nil {
+		return nil, err
+	}
+	
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("block with %d transactions", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		start := len(raw) - r.Len()
+		
+		tx, err := readZcashTx(r)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %v", i, err)
+		}
+		
+		serialized := raw[start:len(raw) - r.Len()]
+		tx.VSize = int64(len(serialized))
+		// since v5 the txid is a tree of hashes of the parts of the transaction (ZIP 244), it is left to the node
+		if tx.Version < 5 {
+			tx.Txid = chainhash.DoubleHashH(serialized).String()
+		}
+		
+		b.Tx = append(b.Tx, tx)
+	}
+	
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after the transactions", r.Len())
+	}
+	
+	return b, nil
+}
+
+// readZcashTx reads a zcash transaction, the shielded parts are skipped except for the value balances
+func readZcashTx(r *bytes.Reader) (*transaction, error) {
+	var header, versionGroup, branchID uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	
+	overwintered := header>>31 == 1
+	tx := &transaction{Version: int32(header & 0x7fffffff)}
+	
+	if overwintered {
+		if err := binary.Read(r, binary.LittleEndian, &versionGroup); err != nil {
+			return nil, err
+		}
+	}
+	
+	if overwintered && tx.Version >= 5 {
+		if err := binary.Read(r, binary.LittleEndian, &branchID); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &tx.Expiry); err != nil {
+			return nil, err
+		}
+		if err := readZcashTransparent(r, tx); err != nil {
+			return nil, err
+		}
+		
+		// sapling spends and outputs
+		spends, err := readZcashItems(r, zcashSpendV5Size)
+		if err != nil {
+			return nil, err
+		}
+		outputs, err := readZcashItems(r, zcashOutputV5Size)
+		if err != nil {
+			return nil, err
+		}
+		var rest uint64
+		if spends + outputs > 0 {
+			if err := binary.Read(r, binary.LittleEndian, &tx.ValueBalanceSapling); err != nil {
+				return nil, err
+			}
+			// binding signature
+			rest += zcashSignatureSize
+		}
+		if spends > 0 {
+			// anchor
+			rest += 32
+		}
+		rest += spends * (zcashProofSize + zcashSignatureSize) + outputs * zcashProofSize
+		if err := skipItems(r, rest, 1); err != nil {
+			return nil, err
+		}
+		
+		// orchard actions
+		actions, err := readZcashItems(r, zcashActionSize)
+		if err != nil {
+			return nil, err
+		}
+		if actions > 0 {
+			// flags, value balance and anchor
+			if err := skipItems(r, 1, 1); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &tx.ValueBalanceOrchard); err != nil {
+				return nil, err
+			}
+			if err := skipItems(r, 32, 1); err != nil {
+				return nil, err
+			}
+			if _, err := readZcashItems(r, 1); err != nil {
+				return nil, err
+			}
+			// spend authorization and binding signatures
+			if err := skipItems(r, actions + 1, zcashSignatureSize); err != nil {
+				return nil, err
+			}
+		}
+		
+		return tx, nil
+	}
+	
+	if err := readZcashTransparent(r, tx); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+		return nil, err
+	}
+	if overwintered && tx.Version >= 3 {
+		if err := binary.Read(r, binary.LittleEndian, &tx.Expiry); err != nil {
+			return nil, err
+		}
+	}
+	
+	var spends, outputs uint64
+	if overwintered && tx.Version >= 4 {
+		if err := binary.Read(r, binary.LittleEndian, &tx.ValueBalanceSapling); err != nil {
+			return nil, err
+		}
+		var err error
+		if spends, err = readZcashItems(r, zcashSpendSize); err != nil {
+			return nil, err
+		}
+		if outputs, err = readZcashItems(r, zcashOutputSize); err != nil {
+			return nil, err
+		}
+	}
+	
+	if tx.Version >= 2 {
+		size := zcashJoinSplitSize
+		if overwintered && tx.Version >= 4 {
+			size = zcashJoinSplitGroth
+		}
+		joinSplits, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		if joinSplits > uint64(r.Len()) / uint64(size) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		// vpub_old and vpub_new come first in every joinsplit
+		for i := uint64(0); i < joinSplits; i++ {
+			var vpub [2]int64
+			if err := binary.Read(r, binary.LittleEndian, &vpub); err != nil {
+				return nil, err
+			}
+			tx.VPubOld += vpub[0]
+			tx.VPubNew += vpub[1]
+			if err := skipItems(r, 1, size - 16); err != nil {
+				return nil, err
+			}
+		}
+		if joinSplits > 0 {
+			// public key and signature
+			if err := skipItems(r, 32 + zcashSignatureSize, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	
+	if spends + outputs > 0 {
+		// binding signature
+		if err := skipItems(r, zcashSignatureSize, 1); err != nil {
+			return nil, err
+		}
+	}
+	
+	return tx, nil
+}
+
+// readZcashTransparent reads the transparent inputs and outputs, which are serialized like in bitcoin
+func readZcashTransparent(r *bytes.Reader, tx *transaction) error {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if count > uint64(r.Len()) {
+		return fmt.Errorf("%d inputs", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		var prevOut wire.OutPoint
+		if _, err := io.ReadFull(r, prevOut.Hash[:]); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &prevOut.Index); err != nil {
+			return err
+		}
+		scriptSig, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "scriptSig")
+		if err != nil {
+			return err
+		}
+		var sequence uint32
+		if err := binary.Read(r, binary.LittleEndian, &sequence); err != nil {
+			return err
+		}
+		
+		tx.Vin = append(tx.Vin, &txIn{
+			Coinbase: count == 1 && prevOut.Index == wire.MaxPrevOutIndex && prevOut.Hash == (chainhash.Hash{}),
+			Txid: prevOut.Hash.String(),
+			Vout: prevOut.Index,
+			ScriptSig: scriptSig,
+			Sequence: sequence,
+		})
+	}
+	
+	if count, err = wire.ReadVarInt(r, 0); err != nil {
+		return err
+	}
+	if count > uint64(r.Len()) {
+		return fmt.Errorf("%d outputs", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		out := new(txOut)
+		if err := binary.Read(r, binary.LittleEndian, &out.Value); err != nil {
+			return err
+		}
+		if out.PkScript, err = wire.ReadVarBytes(r, 0, uint32(r.Len()), "pkScript"); err != nil {
+			return err
+		}
+		tx.Vout = append(tx.Vout, out)
+	}
+	
+	return nil
+}
+
+// readZcashItems skips a list of items of the given size and returns their number
+func readZcashItems(r *bytes.Reader, size int) (uint64, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return 0, err
+	}
+	
+	return count, skipItems(r, count, size)
+}
+
+// skipItems skips count items of the given size
+func skipItems(r *bytes.Reader, count uint64, size int) error {
+	if count > uint64(r.Len()) / uint64(size) {
+		return io.ErrUnexpectedEOF
+	}
+	
+	_, err := r.Seek(int64(count) * int64(size), io.SeekCurrent)
+	return err
+}
+
+// elementsLeafVersion is the leaf version of tapscript on elements chains
+const elementsLeafVersion txscript.TapscriptLeafVersion = 0xc4
+
+// elementsDynafedMask is set in the version of blocks with dynamic federation parameters
+const elementsDynafedMask = 0x80000000
+
+// flags in the index of the outpoint of elements inputs
+const (
+	elementsIssuanceFlag = 1 << 31
+	elementsPeginFlag    = 1 << 30
+	elementsIndexMask    = 0x3fffffff
+)
+
+// decodeElementsBlock decodes a block of an elements chain like liquid. The header has the height and either
+// a signed block proof or the dynamic federation parameters, the transactions have confidential assets and
+// values and the witness follows the outputs.
+func decodeElementsBlock(raw []byte) (*block, error) {
+	r := bytes.NewReader(raw)
+	
+	var (
+		version, blockTime, height uint32
+		prevHash, merkleRoot       chainhash.Hash
+	)
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, prevHash[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, merkleRoot[:]); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &blockTime); err != nil {
+		return nil, err
+	}
+	// liquid has the height in the header (con_blockheightinheader)
+	if err := binary.Read(r, binary.LittleEndian, &height); err != nil {
+		return nil, err
+	}
+	
+	if version & elementsDynafedMask != 0 {
+		// current and proposed parameters
+		for i := 0; i < 2; i++ {
+			if err := skipDynafedParams(r); err != nil {
+				return nil, err
+			}
+		}
+		// signblock witness
+		if _, err := readStack(r); err != nil {
+			return nil, err
+		}
+	} else {
+		// challenge and solution
+		for i := 0; i < 2; i++ {
+			if _, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "proof"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	
+	b := &block{
+		Height: int64(height),
+		Time: int64(blockTime),
+		PreviousHash: prevHash.String(),
+	}
+	
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("block with %d transactions", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		tx, err := readElementsTx(raw, r)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %v", i, err)
+		}
+		b.Tx = append(b.Tx, tx)
+	}
+	
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after the transactions", r.Len())
+	}
+	
+	return b, nil
+}
+
+// skipDynafedParams skips a set of dynamic federation parameters, which are null, compact or full
+func skipDynafedParams(r *bytes.Reader) error {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	
+	switch kind {
+	case 0:
+		return nil
+	case 1, 2:
+		// signblockscript and signblock witness limit
+		if _, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "signblockscript"); err != nil {
+			return err
+		}
+		if err := skipItems(r, 4, 1); err != nil {
+			return err
+		}
+		// compact parameters only have the root of the elided ones
+		if kind == 1 {
+			return skipItems(r, 32, 1)
+		}
+		// fedpeg program, fedpegscript and extension space
+		for i := 0; i < 2; i++ {
+			if _, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "fedpeg"); err != nil {
+				return err
+			}
+		}
+		_, err := readStack(r)
+		return err
+	default:
+		return fmt.Errorf("unknown dynafed parameters %d", kind)
+	}
+}
+
+// readStack reads a list of byte strings like a witness
+func readStack(r *bytes.Reader) ([][]byte, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("stack with %d items", count)
+	}
+	
+	stack := make([][]byte, count)
+	for i := range stack {
+		if stack[i], err = wire.ReadVarBytes(r, 0, uint32(r.Len()), "stack item"); err != nil {
+			return nil, err
+		}
+	}
+	
+	return stack, nil
+}
+
+// readConfidential reads a confidential asset, value or nonce. Explicit ones have the prefix 1 and the
+// given size, blinded ones are commitments of 32 bytes after the prefix and null ones are only the prefix 0.
+func readConfidential(r *bytes.Reader, explicitSize int) (data []byte, blinded bool, err error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+	
+	size := 32
+	switch prefix {
+	case 0:
+		return nil, false, nil
+	case 1:
+		size = explicitSize
+	}
+	
+	data = make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+	
+	return data, prefix != 1, nil
+}
+
+// readElementsTx reads an elements transaction from r, which reads raw
+func readElementsTx(raw []byte, r *bytes.Reader) (*transaction, error) {
+	start := len(raw) - r.Len()
+	
+	tx := new(transaction)
+	if err := binary.Read(r, binary.LittleEndian, &tx.Version); err != nil {
+		return nil, err
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("%d inputs", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		var prevOut wire.OutPoint
+		if _, err := io.ReadFull(r, prevOut.Hash[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &prevOut.Index); err != nil {
+			return nil, err
+		}
+		scriptSig, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "scriptSig")
+		if err != nil {
+			return nil, err
+		}
+		in := &txIn{
+			Txid: prevOut.Hash.String(),
+			Vout: prevOut.Index,
+			ScriptSig: scriptSig,
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Sequence); err != nil {
+			return nil, err
+		}
+		
+		if prevOut.Index == wire.MaxPrevOutIndex {
+			in.Coinbase = count == 1 && prevOut.Hash == (chainhash.Hash{})
+		} else {
+			in.Vout = prevOut.Index & elementsIndexMask
+			// peg-ins spend an output of the main chain
+			in.Coinbase = prevOut.Index & elementsPeginFlag != 0
+			
+			// blinding nonce and entropy, amount and inflation keys of an issuance
+			if prevOut.Index & elementsIssuanceFlag != 0 {
+				if err := skipItems(r, 64, 1); err != nil {
+					return nil, err
+				}
+				for j := 0; j < 2; j++ {
+					if _, _, err := readConfidential(r, 8); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		
+		tx.Vin = append(tx.Vin, in)
+	}
+	
+	if count, err = wire.ReadVarInt(r, 0); err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("%d outputs", count)
+	}
+	
+	for i := uint64(0); i < count; i++ {
+		out := new(txOut)
+		
+		asset, blinded, err := readConfidential(r, 32)
+		if err != nil {
+			return nil, err
+		}
+		if asset != nil && !blinded {
+			var id chainhash.Hash
+			copy(id[:], asset)
+			out.Asset = id.String()
+		}
+		
+		value, blinded, err := readConfidential(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		if blinded {
+			out.Blinded = true
+		} else if value != nil {
+			out.Value = int64(binary.BigEndian.Uint64(value))
+		}
+		
+		// nonce
+		if _, _, err := readConfidential(r, 32); err != nil {
+			return nil, err
+		}
+		
+		if out.PkScript, err = wire.ReadVarBytes(r, 0, uint32(r.Len()), "pkScript"); err != nil {
+			return nil, err
+		}
+		
+		tx.Vout = append(tx.Vout, out)
+	}
+	
+	if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+		return nil, err
+	}
+	
+	// the txid is the hash of the transaction without witness, which has the flags 0
+	end := len(raw) - r.Len()
+	stripped := make([]byte, 0, end - start)
+	stripped = append(stripped, raw[start:start + 4]...)
+	stripped = append(stripped, 0)
+	stripped = append(stripped, raw[start + 5:end]...)
+	tx.Txid = chainhash.DoubleHashH(stripped).String()
+	
+	if flags & 1 != 0 {
+		for _, in := range tx.Vin {
+			// range proofs of the issuance amount and the inflation keys
+			for j := 0; j < 2; j++ {
+				if _, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "rangeproof"); err != nil {
+					return nil, err
+				}
+			}
+			if in.Witness, err = readStack(r); err != nil {
+				return nil, err
+			}
+			// peg-in witness
+			if _, err := readStack(r); err != nil {
+				return nil, err
+			}
+		}
+		for range tx.Vout {
+			// surjection and range proof
+			for j := 0; j < 2; j++ {
+				if _, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "proof"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	
+	// the weight counts the witness once and everything else four times
+	weight := int64(len(stripped) * 3 + len(raw) - r.Len() - start)
+	tx.VSize = (weight + 3) / 4
+	
+	return tx, nil
+}
+
+func (s *rpcSource) Mempool(ctx context.Context) ([]*chainhash.Hash, error) {
+	var res []string
+	if err := s.request(ctx, "getrawmempool", nil, &res); err != nil {
+		return nil, err
+	}
+	
+	txids := make([]*chainhash.Hash, len(res))
+	for i, txid := range res {
+		var err error
+		if txids[i], err = chainhash.NewHashFromStr(txid); err != nil {
+			return nil, err
+		}
+	}
+	
+	return txids, nil
+}
+
+func (s *rpcSource) Transaction(ctx context.Context, txid *chainhash.Hash) (*transaction, error) {
+	if s.decred {
+		var raw json.RawMessage
+		if err := s.request(ctx, "getrawtransaction", []interface{}{txid.String(), 1}, &raw); err != nil {
+			return nil, err
+		}
+		
+		tx, err := newDecredTransaction(raw)
+		if err != nil {
+			return nil, err
+		}
+		tx.Tree = decredTree(tx)
+		
+		return tx, nil
+	}
+	
+	if s.wire == "elements" || s.wire == "zcash" {
+		var (
+			raw      json.RawMessage
+			res      btcjson.TxRawResult
+			elements elementsTx
+			zcash    zcashTx
+		)
+		if err := s.request(ctx, "getrawtransaction", []interface{}{txid.String(), 1}, &raw); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &res); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &zcash); err != nil {
+			return nil, err
+		}
+		
+		tx, err := newTransaction(&res)
+		if err != nil {
+			return nil, err
+		}
+		if s.wire == "elements" {
+			elements.set(tx)
+		} else {
+			zcash.set(tx)
+		}
+		
+		return tx, nil
+	}
+	
+	var res btcjson.TxRawResult
+	if err := s.request(ctx, "getrawtransaction", []interface{}{txid.String(), 1}, &res); err != nil {
+		return nil, err
+	}
+	
+	return newTransaction(&res)
+}
+
+// Transactions fetches the serialized transactions of txids with one batch of requests, nil is returned for the
+// ones which are not found. Transactions which can not be decoded are fetched as json one by one.
+func (s *rpcSource) Transactions(ctx context.Context, txids []*chainhash.Hash) ([]*transaction, error) {
+	txs := make([]*transaction, len(txids))
+	
+	// the json of dcrd and of chains with an unknown serialization is needed
+	if s.decred || s.wire == "" {
+		for i, txid := range txids {
+			tx, err := s.Transaction(ctx, txid)
+			if _, ok := err.(*btcjson.RPCError); ok {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			txs[i] = tx
+		}
+		
+		return txs, nil
+	}
+	
+	s.batchMu.Lock()
+	results := make([]rpcclient.FutureRawResult, len(txids))
+	for i, txid := range txids {
+		results[i] = s.batch.RawRequestAsync("getrawtransaction", []json.RawMessage{json.RawMessage(`"` + txid.String() + `"`)})
+	}
+	err := s.batch.Send()
+	s.batchMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	
+	for i, result := range results {
+		res, err := result.Receive()
+		if _, ok := err.(*btcjson.RPCError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		
+		var rawHex string
+		if err := json.Unmarshal(res, &rawHex); err != nil {
+			return nil, err
+		}
+		raw, err := hex.DecodeString(rawHex)
+		if err != nil {
+			return nil, err
+		}
+		
+		tx, err := decodeTx(s.wire, raw)
+		if err != nil {
+			// e.g. a litecoin transaction with MWEB inputs or outputs
+			log.Debugf("transaction %s: %v, requesting json\n", txids[i], err)
+			if tx, err = s.Transaction(ctx, txids[i]); err != nil {
+				return nil, err
+			}
+		}
+		// the txid of zcash v5 is not the hash of the transaction
+		tx.Txid = txids[i].String()
+		
+		txs[i] = tx
+	}
+	
+	return txs, nil
+}
+
+func (s *rpcSource) PrevOut(ctx context.Context, in *txIn) (*txOut, error) {
+	// known from getblock
+	if in.PrevOut != nil {
+		return in.PrevOut, nil
+	}
+	
+	prevTxHash, err := chainhash.NewHashFromStr(in.Txid)
+	if err != nil {
+		return nil, err
+	}
+	
+	prevTx, err := s.Transaction(ctx, prevTxHash)
+	if err != nil {
+		return nil, err
+	}
+	
+	if int(in.Vout) >= len(prevTx.Vout) {
+		return nil, fmt.Errorf("output %d of tx %s does not exist", in.Vout, in.Txid)
+	}
+	
+	return prevTx.Vout[in.Vout], nil
+}
+
+// decredBlock fetches a block of dcrd with the transactions of the regular and of the stake tree
+func (s *rpcSource) decredBlock(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	var res struct {
+		Hash         string            `json:"hash"`
+		Height       int64             `json:"height"`
+		Time         int64             `json:"time"`
+		Size         int32             `json:"size"`
+		PreviousHash string            `json:"previousblockhash"`
+		NextHash     string            `json:"nextblockhash"`
+		RawTx        []json.RawMessage `json:"rawtx"`
+		RawSTx       []json.RawMessage `json:"rawstx"`
+	}
+	
+	// dcrd takes two flags instead of a verbosity level
+	if err := s.request(ctx, "getblock", []interface{}{h.String(), true, true}, &res); err != nil {
+		return nil, err
+	}
+	
+	b := &block{
+		Hash: res.Hash,
+		Height: res.Height,
+		Time: res.Time,
+		Size: res.Size,
+		PreviousHash: res.PreviousHash,
+		NextHash: res.NextHash,
+	}
+	
+	for tree, rawTxs := range [][]json.RawMessage{res.RawTx, res.RawSTx} {
+		for _, raw := range rawTxs {
+			tx, err := newDecredTransaction(raw)
+			if err != nil {
+				return nil, err
+			}
+			tx.Tree = int8(tree)
+			b.Tx = append(b.Tx, tx)
+		}
+	}
+	
+	return b, nil
+}
+
+// decredTx are the fields of a transaction of dcrd which bitcoind does not know
+type decredTx struct {
+	Expiry uint32 `json:"expiry"`
+	Vin    []struct {
+		// inputs of votes and treasury transactions which do not spend an output
+		Stakebase     string `json:"stakebase"`
+		Treasurybase  bool   `json:"treasurybase"`
+		TreasurySpend string `json:"treasuryspend"`
+	} `json:"vin"`
+	Vout   []struct {
+		Version uint16 `json:"version"`
+	} `json:"vout"`
+}
+
+// newDecredTransaction converts a transaction returned by dcrd
+func newDecredTransaction(raw json.RawMessage) (*transaction, error) {
+	var (
+		res btcjson.TxRawResult
+		dcr decredTx
+	)
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &dcr); err != nil {
+		return nil, err
+	}
+	
+	tx, err := newTransaction(&res)
+	if err != nil {
+		return nil, err
+	}
+	
+	tx.Expiry = dcr.Expiry
+	for i, vin := range dcr.Vin {
+		if vin.Stakebase != "" || vin.Treasurybase || vin.TreasurySpend != "" {
+			tx.Vin[i].Coinbase = true
+		}
+	}
+	for i, vout := range dcr.Vout {
+		tx.Vout[i].Version = vout.Version
+	}
+	
+	return tx, nil
+}
+
+// decredTree tells the tree of a transaction which is not in a block: tickets, votes, revocations
+// and treasury transactions have stake tagged outputs
+func decredTree(tx *transaction) (int8) {
+	for _, out := range tx.Vout {
+		if len(out.PkScript) == 0 {
+			continue
+		}
+		
+		// OP_SSTX, OP_SSGEN, OP_SSRTX, OP_SSTXCHANGE and OP_TADD, OP_TSPEND, OP_TGEN
+		switch op := out.PkScript[0]; {
+		case op >= 0xba && op <= 0xbd, op >= 0xc1 && op <= 0xc3:
+			return 1
+		}
+	}
+	
+	return 0
+}
+
+type zcashBlock struct {
+	Tx []zcashTx `json:"tx"`
+}
+
+// zcashTx are the values of the shielded parts of a transaction of zcashd, in zatoshis
+type zcashTx struct {
+	ValueBalanceZat int64 `json:"valueBalanceZat"`
+	Orchard         struct {
+		ValueBalanceZat int64 `json:"valueBalanceZat"`
+	} `json:"orchard"`
+	VJoinSplit      []struct {
+		VPubOldZat int64 `json:"vpub_oldZat"`
+		VPubNewZat int64 `json:"vpub_newZat"`
+	} `json:"vjoinsplit"`
+}
+
+// set sets the value balances and the sums of vpub_old and vpub_new of tx
+func (z *zcashTx) set(tx *transaction) {
+	tx.ValueBalanceSapling = z.ValueBalanceZat
+	tx.ValueBalanceOrchard = z.Orchard.ValueBalanceZat
+	for _, js := range z.VJoinSplit {
+		tx.VPubOld += js.VPubOldZat
+		tx.VPubNew += js.VPubNewZat
+	}
+}
+
+// elementsBlock are the fields of the transactions of a block of elementsd which bitcoind does not know
+type elementsBlock struct {
+	Tx []elementsTx `json:"tx"`
+}
+
+// elementsTx are the fields of a transaction of elementsd which bitcoind does not know.
+// The value of a blinded output is replaced by a commitment, the asset id of a blinded asset as well.
+type elementsTx struct {
+	Vin  []struct {
+		IsPegin bool            `json:"is_pegin"`
+		PrevOut *elementsOutput `json:"prevout"`
+	} `json:"vin"`
+	Vout []*elementsOutput `json:"vout"`
+}
+
+type elementsOutput struct {
+	Asset           string `json:"asset"`
+	ValueCommitment string `json:"valuecommitment"`
+}
+
+// set sets the assets and blinded values of the outputs of tx and of the known spent outputs
+func (e *elementsTx) set(tx *transaction) {
+	for i, vin := range e.Vin {
+		if i >= len(tx.Vin) {
+			break
+		}
+		// peg-ins spend an output of the main chain
+		if vin.IsPegin {
+			tx.Vin[i].Coinbase = true
+		}
+		if vin.PrevOut != nil && tx.Vin[i].PrevOut != nil {
+			vin.PrevOut.set(tx.Vin[i].PrevOut)
+		}
+	}
+	
+	for i, vout := range e.Vout {
+		if i < len(tx.Vout) && vout != nil {
+			vout.set(tx.Vout[i])
+		}
+	}
+}
+
+func (e *elementsOutput) set(out *txOut) {
+	out.Asset = e.Asset
+	if e.ValueCommitment != "" {
+		out.Value = 0
+		out.Blinded = true
+	}
+}
+
+// blockPrevOuts are the spent outputs returned by getblock with verbosity 3
+type blockPrevOuts struct {
+	Tx []txPrevOuts `json:"tx"`
+}
+
+type txPrevOuts struct {
+	Vin []struct {
+		PrevOut *struct {
+			Value        float64 `json:"value"`
+			ScriptPubKey struct {
+				Hex string `json:"hex"`
+			} `json:"scriptPubKey"`
+		} `json:"prevout"`
+	} `json:"vin"`
+}
+
+// set sets the spent outputs of the inputs of tx
+func (p *txPrevOuts) set(tx *transaction) error {
+	for i, vin := range p.Vin {
+		if vin.PrevOut == nil || i >= len(tx.Vin) {
+			continue
+		}
+		
+		value, err := btcutil.NewAmount(vin.PrevOut.Value)
+		if err != nil {
+			return err
+		}
+		
+		pkScript, err := hex.DecodeString(vin.PrevOut.ScriptPubKey.Hex)
+		if err != nil {
+			return fmt.Errorf("error decoding spent output script of tx %s: %v", tx.Txid, err)
+		}
+		
+		tx.Vin[i].PrevOut = &txOut{Value: int64(value), PkScript: pkScript}
+	}
+	
+	return nil
+}
+
+// newTransaction converts a verbose transaction returned by the node into a transaction
+func newTransaction(res *btcjson.TxRawResult) (*transaction, error) {
+	tx := &transaction{
+		Txid: res.Txid,
+		Version: int32(res.Version),
+		LockTime: res.LockTime,
+		VSize: int64(res.Vsize),
+	}
+	
+	// nodes without segwit only return the size
+	if tx.VSize == 0 {
+		tx.VSize = int64(res.Size)
+	}
+	
+	for _, vin := range res.Vin {
+		in := &txIn{
+			Coinbase: vin.IsCoinBase(),
+			Txid: vin.Txid,
+			Vout: vin.Vout,
+			Sequence: vin.Sequence,
+		}
+		
+		if vin.ScriptSig != nil {
+			script, err := hex.DecodeString(vin.ScriptSig.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding script string from tx %s: %v", res.Txid, err)
+			}
+			in.ScriptSig = script
+		}
+		
+		for _, item := range vin.Witness {
+			witness, err := hex.DecodeString(item)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding witness from tx %s: %v", res.Txid, err)
+			}
+			in.Witness = append(in.Witness, witness)
+		}
+		
+		tx.Vin = append(tx.Vin, in)
+	}
+	
+	for _, vout := range res.Vout {
+		value, err := btcutil.NewAmount(vout.Value)
+		if err != nil {
+			return nil, err
+		}
+		
+		pkScript, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding output script from tx %s: %v", res.Txid, err)
+		}
+		
+		tx.Vout = append(tx.Vout, &txOut{
+			Value: int64(value),
+			PkScript: pkScript,
+		})
+	}
+	
+	return tx, nil
+}
+
+// block status flags and limits of Bitcoin Core (chain.h, script.h)
+const (
+	blockValidMask    = 7
+	blockValidScripts = 5
+	blockHaveData     = 8
+	blockHaveUndo     = 16
+	blockFailedMask   = 32 | 64
+	maxScriptSize     = 10000
+)
+
+// diskBlockIndex is an entry of the block index database of Bitcoin Core (CDiskBlockIndex)
+type diskBlockIndex struct {
+	Height  int64
+	Status  uint64
+	File    int64
+	DataPos int64
+	UndoPos int64
+	Header  wire.BlockHeader
+	// total work of the chain up to this block, which the block index does not store
+	ChainWork *big.Int
+	// the block and all blocks before it are stored and connected and none of them is invalid
+	Valid     bool
+}
+
+// esploraSource is a blockSource using the HTTP API of an Esplora (or Electrs) indexer, so no credentials of
+// a node are needed. The spent outputs are part of the transactions.
+type esploraSource struct {
+	url         string
+	client      *http.Client
+	concurrency int
+	retries     int
+	// the delay before the first retry, it doubles with every retry
+	delay       time.Duration
+}
+
+// esploraTxsPerPage is the number of transactions returned by /block/:hash/txs/:start_index
+const esploraTxsPerPage = 25
+
+func newEsploraSource(url string, concurrency, retries int) *esploraSource {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	
+	return &esploraSource{
+		url: strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: time.Minute},
+		concurrency: concurrency,
+		retries: retries,
+		delay: time.Second,
+	}
+}
+
+// esploraBlock is a block returned by /block/:hash
+type esploraBlock struct {
+	ID                string `json:"id"`
+	Height            int64  `json:"height"`
+	Timestamp         int64  `json:"timestamp"`
+	TxCount           int    `json:"tx_count"`
+	Size              int32  `json:"size"`
+	PreviousBlockHash string `json:"previousblockhash"`
+}
+
+// esploraTx is a transaction returned by /tx/:txid or /block/:hash/txs/:start_index
+type esploraTx struct {
+	Txid     string `json:"txid"`
+	Version  int32  `json:"version"`
+	LockTime uint32 `json:"locktime"`
+	Weight   int64  `json:"weight"`
+	Vin      []struct {
+		Txid       string      `json:"txid"`
+		Vout       uint32      `json:"vout"`
+		PrevOut    *esploraOut `json:"prevout"`
+		ScriptSig  string      `json:"scriptsig"`
+		Witness    []string    `json:"witness"`
+		IsCoinbase bool        `json:"is_coinbase"`
+		IsPegin    bool        `json:"is_pegin"`
+		Sequence   uint32      `json:"sequence"`
+	} `json:"vin"`
+	Vout     []*esploraOut `json:"vout"`
+}
+
+type esploraOut struct {
+	ScriptPubKey    string `json:"scriptpubkey"`
+	Value           int64  `json:"value"`
+	// elements only, the value commitment replaces the value of blinded outputs
+	Asset           string `json:"asset"`
+	ValueCommitment string `json:"valuecommitment"`
+}
+
+func (o *esploraOut) txOut(pkScript []byte) (*txOut) {
+	return &txOut{
+		Value: o.Value,
+		PkScript: pkScript,
+		Asset: o.Asset,
+		Blinded: o.ValueCommitment != "",
+	}
+}
+
+// get requests a path of the API. Failed requests and responses with a server error or 429 (too many
+// requests) are retried with an increasing delay.
+func (s *esploraSource) get(ctx context.Context, path string) ([]byte, error) {
+	delay := s.delay
+	
+	for try := 0; ; try++ {
+		body, retry, err := s.getOnce(ctx, path)
+		if err == nil || !retry || try >= s.retries {
+			return body, err
+		}
+		
+		log.Debugf("esplora: %v, retrying in %v\n", err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// getOnce requests a path of the API once and tells whether to retry on errors
+func (s *esploraSource) getOnce(ctx context.Context, path string) ([]byte, bool, error) {
+	req, err := http.NewRequest("GET", s.url + path, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+	
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	
+	if res.StatusCode != http.StatusOK {
+		retry := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return nil, retry, fmt.Errorf("GET %s: %s: %s", path, res.Status, bytes.TrimSpace(body))
+	}
+	
+	return body, false, nil
+}
+
+func (s *esploraSource) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := s.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("GET %s: %v", path, err)
+	}
+	
+	return nil
+}
+
+func (s *esploraSource) BestHeight(ctx context.Context) (int64, error) {
+	body, err := s.get(ctx, "/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	
+	return strconv.ParseInt(string(bytes.TrimSpace(body)), 10, 64)
+}
+
+func (s *esploraSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	body, err := s.get(ctx, "/block-height/" + strconv.FormatInt(height, 10))
+	if err != nil {
+		return nil, err
+	}
+	
+	return chainhash.NewHashFromStr(string(bytes.TrimSpace(body)))
+}
+
+func (s *esploraSource) BlockHeader(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	var res esploraBlock
+	if err := s.getJSON(ctx, "/block/" + h.String(), &res); err != nil {
+		return nil, err
+	}
+	
+	return &block{
+		Hash: res.ID,
+		Height: res.Height,
+		Time: res.Timestamp,
+		Size: res.Size,
+		PreviousHash: res.PreviousBlockHash,
+	}, nil
+}
+
+func (s *esploraSource) Block(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	var res esploraBlock
+	if err := s.getJSON(ctx, "/block/" + h.String(), &res); err != nil {
+		return nil, err
+	}
+	
+	b := &block{
+		Hash: res.ID,
+		Height: res.Height,
+		Time: res.Timestamp,
+		Size: res.Size,
+		PreviousHash: res.PreviousBlockHash,
+		Tx: make([]*transaction, res.TxCount),
+	}
+	
+	// fetch all pages of transactions in parallel
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	
+	// and the hash of the next block, so a forward scan does not have to look it up by height after the block
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		next, err := s.BlockHash(ctx, res.Height + 1)
+		if err != nil {
+			// there is no next block at the tip
+			log.Debugf("esplora: no block after %d: %v\n", res.Height, err)
+			return
+		}
+		b.NextHash = next.String()
+	}()
+	jobs := make(chan int)
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range jobs {
+				var txs []*esploraTx
+				err := s.getJSON(ctx, "/block/" + h.String() + "/txs/" + strconv.Itoa(start), &txs)
+				for i := 0; err == nil && i < len(txs) && start + i < len(b.Tx); i++ {
+					b.Tx[start + i], err = txs[i].transaction()
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for start := 0; start < res.TxCount; start += esploraTxsPerPage {
+		jobs <- start
+	}
+	close(jobs)
+	wg.Wait()
+	
+	if firstErr != nil {
+		return nil, fmt.Errorf("error getting txs in block %d: %v", res.Height, firstErr)
+	}
+	
+	for i, tx := range b.Tx {
+		if tx == nil {
+			return nil, fmt.Errorf("error getting txs in block %d: tx %d is missing", res.Height, i)
+		}
+	}
+	
+	return b, nil
+}
+
+func (s *esploraSource) Transaction(ctx context.Context, txid *chainhash.Hash) (*transaction, error) {
+	var res esploraTx
+	if err := s.getJSON(ctx, "/tx/" + txid.String(), &res); err != nil {
+		return nil, err
+	}
+	
+	return res.transaction()
+}
+
+func (s *esploraSource) PrevOut(ctx context.Context, in *txIn) (*txOut, error) {
+	if in.PrevOut != nil {
+		return in.PrevOut, nil
+	}
+	
+	prevTxHash, err := chainhash.NewHashFromStr(in.Txid)
+	if err != nil {
+		return nil, err
+	}
+	
+	prevTx, err := s.Transaction(ctx, prevTxHash)
+	if err != nil {
+		return nil, err
+	}
+	
+	if int(in.Vout) >= len(prevTx.Vout) {
+		return nil, fmt.Errorf("output %d of tx %s does not exist", in.Vout, in.Txid)
+	}
+	
+	return prevTx.Vout[in.Vout], nil
+}
+
+func (s *esploraSource) Mempool(ctx context.Context) ([]*chainhash.Hash, error) {
+	var txids []string
+	if err := s.getJSON(ctx, "/mempool/txids", &txids); err != nil {
+		return nil, err
+	}
+	
+	hashes := make([]*chainhash.Hash, 0, len(txids))
+	for _, txid := range txids {
+		h, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	
+	return hashes, nil
+}
+
+// transaction converts a transaction returned by Esplora
+func (res *esploraTx) transaction() (*transaction, error) {
+	tx := &transaction{
+		Txid: res.Txid,
+		Version: res.Version,
+		LockTime: res.LockTime,
+		VSize: (res.Weight + 3) / 4,
+	}
+	
+	decode := func(s string) ([]byte, error) {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding tx %s: %v", res.Txid, err)
+		}
+		return b, nil
+	}
+	
+	for _, vin := range res.Vin {
+		in := &txIn{
+			Coinbase: vin.IsCoinbase || vin.IsPegin,
+			Txid: vin.Txid,
+			Vout: vin.Vout,
+			Sequence: vin.Sequence,
+		}
+		
+		var err error
+		if in.ScriptSig, err = decode(vin.ScriptSig); err != nil {
+			return nil, err
+		}
+		
+		for _, item := range vin.Witness {
+			witness, err := decode(item)
+			if err != nil {
+				return nil, err
+			}
+			in.Witness = append(in.Witness, witness)
+		}
+		
+		if vin.PrevOut != nil {
+			pkScript, err := decode(vin.PrevOut.ScriptPubKey)
+			if err != nil {
+				return nil, err
+			}
+			in.PrevOut = vin.PrevOut.txOut(pkScript)
+		}
+		
+		tx.Vin = append(tx.Vin, in)
+	}
+	
+	for _, vout := range res.Vout {
+		pkScript, err := decode(vout.ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		tx.Vout = append(tx.Vout, vout.txOut(pkScript))
+	}
+	
+	return tx, nil
+}
+
+// cachedSource is a blockSource which remembers the outputs of the blocks it returned, so the spent
+// outputs of later blocks do not have to be looked up by the node (which needs a txindex).
+// The oldest outputs are dropped when the cache is full.
+// The outputs of the last depth blocks are known by block, so they can be dropped if the block is orphaned.
+type cachedSource struct {
+	blockSource
+	size   int
+	depth  int
+	mu     sync.Mutex
+	outs   map[string]*txOut
+	// the keys of outs in the order they were added
+	order  []string
+	next   int
+	// the last blocks returned with the keys of their outputs and their positions in order
+	blocks []cachedBlock
+}
+
+type cachedBlock struct {
+	hash  string
+	keys  []string
+	slots []int
+}
+
+// newCachedSource wraps src in a cache of size outputs, a size of 0 or less disables the cache and
+// returns src itself
+func newCachedSource(src blockSource, size, depth int) blockSource {
+	if size <= 0 {
+		return src
+	}
+	
+	return &cachedSource{
+		blockSource: src,
+		size: size,
+		depth: depth,
+		outs: make(map[string]*txOut),
+		order: make([]string, size),
+	}
+}
+
+func outPointKey(txid string, vout uint32) string {
+	return txid + ":" + strconv.FormatUint(uint64(vout), 10)
+}
+
+func (s *cachedSource) Block(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	b, err := s.blockSource.Block(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	cached := cachedBlock{hash: b.Hash}
+	for _, tx := range b.Tx {
+		for vout, out := range tx.Vout {
+			key := outPointKey(tx.Txid, uint32(vout))
+			if _, ok := s.outs[key]; ok {
+				continue
+			}
+			
+			delete(s.outs, s.order[s.next])
+			s.order[s.next] = key
+			cached.keys = append(cached.keys, key)
+			cached.slots = append(cached.slots, s.next)
+			s.next = (s.next + 1) % s.size
+			s.outs[key] = out
+		}
+	}
+	
+	s.blocks = append(s.blocks, cached)
+	if len(s.blocks) > s.depth {
+		s.blocks = s.blocks[len(s.blocks) - s.depth:]
+	}
+	
+	return b, nil
+}
+
+// forget drops the outputs of an orphaned block, they are unknown if the block is older than the last depth blocks
+func (s *cachedSource) forget(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	for i := len(s.blocks) - 1; i >= 0; i-- {
+		if s.blocks[i].hash != hash {
+			continue
+		}
+		
+		for j, slot := range s.blocks[i].slots {
+			// the output might already be replaced by one of a later block
+			if key := s.blocks[i].keys[j]; s.order[slot] == key {
+				delete(s.outs, key)
+				s.order[slot] = ""
+			}
+		}
+		s.blocks = append(s.blocks[:i], s.blocks[i + 1:]...)
+		return
+	}
+}
+
+func (s *cachedSource) PrevOut(ctx context.Context, in *txIn) (*txOut, error) {
+	if in.PrevOut != nil {
+		return in.PrevOut, nil
+	}
+	
+	if out := s.cachedPrevOut(in); out != nil {
+		return out, nil
+	}
+	
+	return s.blockSource.PrevOut(ctx, in)
+}
+
+// cachedPrevOut returns the output spent by in if it is in the cache, nil otherwise
+func (s *cachedSource) cachedPrevOut(in *txIn) *txOut {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	return s.outs[outPointKey(in.Txid, in.Vout)]
+}
+
+// fileSource is a blockSource reading the blk*.dat and rev*.dat files of a stopped Bitcoin Core compatible node.
+// Blocks and their undo data are located with the block index database (blocks/index) of the node.
+// The outputs spent by the inputs are taken from the undo data, so neither a running node nor a txindex is needed.
+type fileSource struct {
+	dir    string
+	xorKey []byte
+	index  map[chainhash.Hash]*diskBlockIndex
+	chain  []chainhash.Hash
+	mu     sync.Mutex
+	files  map[string]*os.File
+}
+
+func newFileSource(dataDir string) (*fileSource, error) {
+	s := &fileSource{
+		dir: filepath.Join(dataDir, "blocks"),
+		index: make(map[chainhash.Hash]*diskBlockIndex),
+		files: make(map[string]*os.File),
+	}
+	
+	// since Bitcoin Core 28 the block files are obfuscated with the key from xor.dat
+	key, err := ioutil.ReadFile(filepath.Join(s.dir, "xor.dat"))
+	if err == nil {
+		for _, b := range key {
+			if b != 0 {
+				s.xorKey = key
+				break
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	
+	db, err := leveldb.OpenFile(filepath.Join(s.dir, "index"), &opt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("error opening block index: %v", err)
+	}
+	defer db.Close()
+	
+	iter := db.NewIterator(util.BytesPrefix([]byte{'b'}), nil)
+	for iter.Next() {
+		var h chainhash.Hash
+		copy(h[:], iter.Key()[1:])
+		
+		entry, err := readDiskBlockIndex(iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("error reading block index entry %s: %v", h, err)
+		}
+		s.index[h] = entry
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	
+	// like the node the best chain is the one with the most work of which all blocks are stored and valid,
+	// the work is summed up from the targets of the headers with the parents coming first
+	entries := make([]*diskBlockIndex, 0, len(s.index))
+	for _, entry := range s.index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Height < entries[j].Height
+	})
+	
+	var tip *diskBlockIndex
+	for _, entry := range entries {
+		entry.ChainWork = blockchain.CalcWork(entry.Header.Bits)
+		entry.Valid = entry.Status&blockHaveData != 0 && entry.Status&blockFailedMask == 0
+		if entry.Height > 0 {
+			prev, ok := s.index[entry.Header.PrevBlock]
+			if ok {
+				entry.ChainWork.Add(entry.ChainWork, prev.ChainWork)
+			}
+			
+			// blocks which were stored but never connected have neither undo data nor valid scripts,
+			// only the genesis block is never connected
+			connected := entry.Status&blockHaveUndo != 0 || entry.Status&blockValidMask >= blockValidScripts
+			entry.Valid = entry.Valid && connected && ok && prev.Valid
+		}
+		
+		if entry.Valid && (tip == nil || entry.ChainWork.Cmp(tip.ChainWork) > 0) {
+			tip = entry
+		}
+	}
+	
+	if tip == nil {
+		return nil, fmt.Errorf("no blocks found in %s", s.dir)
+	}
+	
+	// walk back from the tip to build the height to hash mapping
+	s.chain = make([]chainhash.Hash, tip.Height + 1)
+	h := tip.Header.BlockHash()
+	for entry := tip; ; {
+		s.chain[entry.Height] = h
+		if entry.Height == 0 {
+			break
+		}
+		h = entry.Header.PrevBlock
+		prev, ok := s.index[h]
+		if !ok {
+			return nil, fmt.Errorf("block index misses block %s", h)
+		}
+		entry = prev
+	}
+	
+	return s, nil
+}
+
+// readDiskBlockIndex decodes a serialized CDiskBlockIndex
+func readDiskBlockIndex(raw []byte) (*diskBlockIndex, error) {
+	r := bytes.NewReader(raw)
+	entry := new(diskBlockIndex)
+	
+	// client version
+	if _, err := readCoreVarInt(r); err != nil {
+		return nil, err
+	}
+	
+	height, err := readCoreVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	entry.Height = int64(height)
+	
+	if entry.Status, err = readCoreVarInt(r); err != nil {
+		return nil, err
+	}
+	
+	// number of transactions
+	if _, err = readCoreVarInt(r); err != nil {
+		return nil, err
+	}
+	
+	if entry.Status&(blockHaveData|blockHaveUndo) != 0 {
+		file, err := readCoreVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		entry.File = int64(file)
+	}
+	
+	if entry.Status&blockHaveData != 0 {
+		pos, err := readCoreVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		entry.DataPos = int64(pos)
+	}
+	
+	if entry.Status&blockHaveUndo != 0 {
+		pos, err := readCoreVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		entry.UndoPos = int64(pos)
+	}
+	
+	if err := entry.Header.Deserialize(r); err != nil {
+		return nil, err
+	}
+	
+	return entry, nil
+}
+
+// readCoreVarInt reads the variable length integer format Bitcoin Core uses on disk (VARINT in serialize.h).
+// It is not the same as the CompactSize format used in blocks and transactions.
+func readCoreVarInt(r io.ByteReader) (uint64, error) {
+	var n uint64
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = (n << 7) | uint64(b & 0x7f)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		n++
+	}
+}
+
+// read returns size bytes at the position pos of a block or undo file with the obfuscation removed
+func (s *fileSource) read(name string, pos int64, size int) ([]byte, error) {
+	s.mu.Lock()
+	f, ok := s.files[name]
+	if !ok {
+		var err error
+		f, err = os.Open(filepath.Join(s.dir, name))
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.files[name] = f
+	}
+	s.mu.Unlock()
+	
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, pos); err != nil {
+		return nil, fmt.Errorf("error reading %s at %d: %v", name, pos, err)
+	}
+	
+	if len(s.xorKey) > 0 {
+		for i := range buf {
+			buf[i] ^= s.xorKey[(pos + int64(i)) % int64(len(s.xorKey))]
+		}
+	}
+	
+	return buf, nil
+}
+
+// readRecord returns the data of a record in a block or undo file, which is preceded by the message start and its size
+func (s *fileSource) readRecord(name string, pos int64) ([]byte, error) {
+	if pos < 8 {
+		return nil, fmt.Errorf("invalid position %d in %s", pos, name)
+	}
+	
+	sizeBytes, err := s.read(name, pos - 4, 4)
+	if err != nil {
+		return nil, err
+	}
+	
+	return s.read(name, pos, int(binary.LittleEndian.Uint32(sizeBytes)))
+}
+
+func (s *fileSource) BestHeight(ctx context.Context) (int64, error) {
+	return int64(len(s.chain) - 1), nil
+}
+
+func (s *fileSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	if height < 0 || height >= int64(len(s.chain)) {
+		return nil, fmt.Errorf("block height %d is out of range", height)
+	}
+	
+	h := s.chain[height]
+	return &h, nil
+}
+
+// BlockHeader takes the header from the block index, the size of the block is not known there
+func (s *fileSource) BlockHeader(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	entry, ok := s.index[*h]
+	if !ok {
+		return nil, fmt.Errorf("block %s is not in the block index", h)
+	}
+	
+	b := &block{
+		Hash: h.String(),
+		Height: entry.Height,
+		Time: entry.Header.Timestamp.Unix(),
+		PreviousHash: entry.Header.PrevBlock.String(),
+	}
+	if entry.Height + 1 < int64(len(s.chain)) && s.chain[entry.Height] == *h {
+		b.NextHash = s.chain[entry.Height + 1].String()
+	}
+	
+	return b, nil
+}
+
+func (s *fileSource) Block(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	entry, ok := s.index[*h]
+	if !ok || entry.Status&blockHaveData == 0 {
+		return nil, fmt.Errorf("block %s is not stored", h)
+	}
+	
+	raw, err := s.readRecord(fmt.Sprintf("blk%05d.dat", entry.File), entry.DataPos)
+	if err != nil {
+		return nil, err
+	}
+	
+	var msgBlock wire.MsgBlock
+	r := bytes.NewReader(raw)
+	if err := msgBlock.Deserialize(r); err != nil {
+		return nil, fmt.Errorf("error decoding block %s: %v", h, err)
+	}
+	// litecoin appends the extension block of MWEB to the transactions
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("error decoding block %s: %d bytes after the transactions, MWEB blocks are not supported", h, r.Len())
+	}
+	
+	b := &block{
+		Hash: h.String(),
+		Height: entry.Height,
+		Time: msgBlock.Header.Timestamp.Unix(),
+		Size: int32(len(raw)),
+		PreviousHash: msgBlock.Header.PrevBlock.String(),
+	}
+	if entry.Height + 1 < int64(len(s.chain)) {
+		b.NextHash = s.chain[entry.Height + 1].String()
+	}
+	
+	for _, msgTx := range msgBlock.Transactions {
+		b.Tx = append(b.Tx, newTransactionFromWire(msgTx))
+	}
+	
+	// the undo data holds the spent outputs of all inputs but the coinbase
+	if entry.Status&blockHaveUndo != 0 {
+		rawUndo, err := s.readRecord(fmt.Sprintf("rev%05d.dat", entry.File), entry.UndoPos)
+		if err != nil {
+			return nil, err
+		}
+		
+		if err := readBlockUndo(rawUndo, b); err != nil {
+			return nil, fmt.Errorf("error decoding undo data of block %s: %v", h, err)
+		}
+	}
+	
+	return b, nil
+}
+
+func (s *fileSource) Transaction(ctx context.Context, txid *chainhash.Hash) (*transaction, error) {
+	return nil, fmt.Errorf("looking up single transactions is not possible in block files")
+}
+
+func (s *fileSource) Mempool(ctx context.Context) ([]*chainhash.Hash, error) {
+	return nil, fmt.Errorf("there is no mempool in block files")
+}
+
+func (s *fileSource) PrevOut(ctx context.Context, in *txIn) (*txOut, error) {
+	if in.PrevOut == nil {
+		return nil, fmt.Errorf("no undo data for input %s:%d", in.Txid, in.Vout)
+	}
+	
+	return in.PrevOut, nil
+}
+
+// readBlockUndo decodes a serialized CBlockUndo and attaches the spent outputs to the inputs of the block
+func readBlockUndo(raw []byte, b *block) error {
+	r := bytes.NewReader(raw)
+	
+	txCount, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if txCount != uint64(len(b.Tx) - 1) {
+		return fmt.Errorf("undo data for %d transactions, block has %d", txCount, len(b.Tx) - 1)
+	}
+	
+	for _, tx := range b.Tx[1:] {
+		inCount, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return err
+		}
+		if inCount != uint64(len(tx.Vin)) {
+			return fmt.Errorf("undo data for %d inputs, tx %s has %d", inCount, tx.Txid, len(tx.Vin))
+		}
+		
+		for _, in := range tx.Vin {
+			if in.PrevOut, err = readTxInUndo(r); err != nil {
+				return err
+			}
+		}
+	}
+	
+	return nil
+}
+
+// readTxInUndo decodes a single spent output of the undo data (TxInUndoFormatter in undo.h)
+func readTxInUndo(r *bytes.Reader) (*txOut, error) {
+	code, err := readCoreVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	
+	// old versions stored the version of the spent transaction after the height
+	if code >> 1 > 0 {
+		if _, err := readCoreVarInt(r); err != nil {
+			return nil, err
+		}
+	}
+	
+	compressedValue, err := readCoreVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	
+	pkScript, err := readCompressedScript(r)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &txOut{
+		Value: int64(decompressAmount(compressedValue)),
+		PkScript: pkScript,
+	}, nil
+}
+
+// decompressAmount reverses the amount compression of Bitcoin Core (compressor.cpp)
+func decompressAmount(x uint64) uint64 {
+	if x == 0 {
+		return 0
+	}
+	x--
+	
+	e := x % 10
+	x /= 10
+	
+	n := uint64(0)
+	if e < 9 {
+		d := x % 9 + 1
+		x /= 9
+		n = x * 10 + d
+	} else {
+		n = x + 1
+	}
+	
+	for ; e > 0; e-- {
+		n *= 10
+	}
+	
+	return n
+}
+
+// readCompressedScript reverses the script compression of Bitcoin Core (compressor.cpp)
+func readCompressedScript(r *bytes.Reader) ([]byte, error) {
+	size, err := readCoreVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	
+	// the special scripts 0 to 5 are stored without their opcodes
+	special := 0
+	switch size {
+	case 0, 1:
+		special = 20
+	case 2, 3, 4, 5:
+		special = 32
+	}
+	
+	if special > 0 {
+		data := make([]byte, special)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		
+		switch size {
+		case 0:
+			// P2PKH
+			script := []byte{txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20}
+			script = append(script, data...)
+			return append(script, txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG), nil
+		case 1:
+			// P2SH
+			script := []byte{txscript.OP_HASH160, txscript.OP_DATA_20}
+			script = append(script, data...)
+			return append(script, txscript.OP_EQUAL), nil
+		case 2, 3:
+			// P2PK with compressed key
+			script := []byte{txscript.OP_DATA_33, byte(size)}
+			script = append(script, data...)
+			return append(script, txscript.OP_CHECKSIG), nil
+		default:
+			// P2PK with uncompressed key, which is stored compressed
+			pubKey, err := btcec.ParsePubKey(append([]byte{byte(size - 2)}, data...))
+			if err != nil {
+				return nil, err
+			}
+			script := []byte{txscript.OP_DATA_65}
+			script = append(script, pubKey.SerializeUncompressed()...)
+			return append(script, txscript.OP_CHECKSIG), nil
+		}
+	}
+	
+	size -= 6
+	if size > maxScriptSize {
+		// oversized scripts are unspendable and replaced with OP_RETURN
+		if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return []byte{txscript.OP_RETURN}, nil
+	}
+	
+	script := make([]byte, size)
+	if _, err := io.ReadFull(r, script); err != nil {
+		return nil, err
+	}
+	
+	return script, nil
+}
+
+// newTransactionFromWire converts a deserialized transaction into a transaction
+func newTransactionFromWire(msgTx *wire.MsgTx) (*transaction) {
+	// the weight counts the witness once and everything else four times
+	weight := int64(msgTx.SerializeSizeStripped() * 3 + msgTx.SerializeSize())
+	
+	tx := &transaction{
+		Txid: msgTx.TxHash().String(),
+		Version: msgTx.Version,
+		LockTime: msgTx.LockTime,
+		VSize: (weight + 3) / 4,
+	}
+	
+	coinbase := blockchain.IsCoinBaseTx(msgTx)
+	
+	for _, in := range msgTx.TxIn {
+		tx.Vin = append(tx.Vin, newTxInFromWire(in, coinbase))
+	}
+	
+	for _, out := range msgTx.TxOut {
+		tx.Vout = append(tx.Vout, &txOut{
+			Value: out.Value,
+			PkScript: out.PkScript,
+		})
+	}
+	
+	return tx
+}
+
+func newTxInFromWire(in *wire.TxIn, coinbase bool) (*txIn) {
+	return &txIn{
+		Coinbase: coinbase,
+		Txid: in.PreviousOutPoint.Hash.String(),
+		Vout: in.PreviousOutPoint.Index,
+		ScriptSig: in.SignatureScript,
+		Witness: in.Witness,
+		Sequence: in.Sequence,
+	}
+}
+
+// parsedOp is a single opcode of a script together with the data it pushes
+type parsedOp struct {
+	Opcode byte
+	Data   []byte
+}
+
+// parseScript splits a script into its opcodes
+func parseScript(script []byte) ([]parsedOp, error) {
+	var pops []parsedOp
+	
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	for tokenizer.Next() {
+		pops = append(pops, parsedOp{
+			Opcode: tokenizer.Opcode(),
+			Data: tokenizer.Data(),
+		})
+	}
+	
+	return pops, tokenizer.Err()
+}
+
+// disasm returns the asm of parsed opcodes the way bitcoind's decodescript shows it:
+// data pushes of up to 4 bytes are shown as numbers, longer ones hex encoded.
+func disasm(pops []parsedOp) ([]string) {
+	asm := make([]string, 0, len(pops))
+	
+	for _, pop := range pops {
+		op := pop.Opcode
+		switch {
+		case op <= txscript.OP_PUSHDATA4:
+			if len(pop.Data) <= 4 {
+				asm = append(asm, strconv.FormatInt(scriptNum(pop.Data), 10))
+			} else {
+				asm = append(asm, hex.EncodeToString(pop.Data))
+			}
+		case op == txscript.OP_1NEGATE:
+			asm = append(asm, "-1")
+		case op >= txscript.OP_1 && op <= txscript.OP_16:
+			asm = append(asm, strconv.Itoa(int(op - txscript.OP_1 + 1)))
+		default:
+			name, _ := txscript.DisasmString([]byte{op})
+			asm = append(asm, name)
+		}
+	}
+	
+	return asm
+}
+
+// scriptNum interprets data as a little endian sign-magnitude number like CScriptNum
+func scriptNum(data []byte) (int64) {
+	if len(data) == 0 {
+		return 0
+	}
+	
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8 * i)
+	}
+	
+	last := len(data) - 1
+	if data[last]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8 * last)
+		return -n
+	}
+	
+	return n
+}
+
+// the ways a script hash output can be spent
+const (
+	spendP2SH      = "p2sh"
+	spendP2WSH     = "p2wsh"
+	spendP2SHP2WSH = "p2sh-p2wsh"
+	spendP2TR      = "p2tr"
+	// the script is not hashed but the script of the spent output itself
+	spendBare      = "bare"
+)
+
+// isWitnessScriptHash checks if a script is a version 0 witness program of a script hash
+func isWitnessScriptHash(script []byte) (bool) {
+	return len(script) == 34 && script[0] == txscript.OP_0 && script[1] == txscript.OP_DATA_32
+}
+
+// pushOp returns the datapush which puts data onto the stack
+func pushOp(data []byte) (parsedOp) {
+	op := byte(txscript.OP_0)
+	switch {
+	case len(data) == 0:
+	case len(data) <= txscript.OP_DATA_75:
+		op = byte(len(data))
+	case len(data) <= 0xff:
+		op = txscript.OP_PUSHDATA1
+	case len(data) <= 0xffff:
+		op = txscript.OP_PUSHDATA2
+	default:
+		op = txscript.OP_PUSHDATA4
+	}
+	
+	return parsedOp{
+		Opcode: op,
+		Data: data,
+	}
+}
+
+// witnessOps turns the items of a witness stack into the datapushes which would put them onto the stack,
+// so they can be shown as asm just like a scriptSig (an empty item becomes "0").
+func witnessOps(witness [][]byte) ([]parsedOp) {
+	pops := make([]parsedOp, len(witness))
+	
+	for i, item := range witness {
+		pops[i] = pushOp(item)
+	}
+	
+	return pops
+}
+
+// spend describes the script executed by an input
+type spend struct {
+	// the stack items of the input, the last one is the executed script
+	Stack        []parsedOp
+	// the executed script
+	RedeemScript []byte
+	RedeemOps    []parsedOp
+	Type         string
+	// only set for taproot script path spends
+	ControlBlock *txscript.ControlBlock
+}
+
+// tapscriptSpend checks if the witness of an input is a taproot script path spend.
+// If the spent output is known it decides, otherwise the control block has to be valid.
+func tapscriptSpend(in *txIn) (witness [][]byte, cb *txscript.ControlBlock, ok bool) {
+	if len(in.ScriptSig) > 0 {
+		return nil, nil, false
+	}
+	if in.PrevOut != nil && !txscript.IsPayToTaproot(in.PrevOut.PkScript) {
+		return nil, nil, false
+	}
+	
+	witness = in.Witness
+	
+	// drop the annex
+	if len(witness) >= 2 && len(witness[len(witness) - 1]) > 0 && witness[len(witness) - 1][0] == txscript.TaprootAnnexTag {
+		witness = witness[:len(witness) - 1]
+	}
+	
+	// a script path spend has at least the script and the control block
+	if len(witness) < 2 {
+		return nil, nil, false
+	}
+	
+	cb, err := txscript.ParseControlBlock(witness[len(witness) - 1])
+	if err != nil || cb.LeafVersion != leafVersion {
+		return nil, nil, false
+	}
+	
+	return witness[:len(witness) - 1], cb, true
+}
+
+// redeemScript finds the script executed by an input: the tapscript leaf for taproot script path spends,
+// the last item of the witness for other segwit spends and the last datapush of the scriptSig otherwise.
+// If the input does not contain a script, ok is false.
+func redeemScript(in *txIn) (*spend, bool) {
+	var (
+		stack []parsedOp
+		err   error
+	)
+	s := new(spend)
+	
+	if witness, cb, ok := tapscriptSpend(in); ok {
+		s.Type = spendP2TR
+		s.ControlBlock = cb
+		
+		stack = witnessOps(witness)
+	} else if len(in.Witness) > 0 {
+		s.Type = spendP2WSH
+		
+		// nested segwit puts the witness program into the scriptSig
+		if len(in.ScriptSig) > 0 {
+			pops, err := parseScript(in.ScriptSig)
+			if err != nil || len(pops) != 1 || !isWitnessScriptHash(pops[0].Data) {
+				return nil, false
+			}
+			s.Type = spendP2SHP2WSH
+		}
+		
+		stack = witnessOps(in.Witness)
+	} else {
+		s.Type = spendP2SH
+		
+		// if the script can not be parsed it can not contain a redeem script
+		stack, err = parseScript(in.ScriptSig)
+		if err != nil {
+			return nil, false
+		}
+	}
+	
+	// e.g. a scriptSig ending with a small integer
+	if len(stack) == 0 || len(stack[len(stack) - 1].Data) == 0 {
+		return nil, false
+	}
+	
+	s.Stack = stack
+	s.RedeemScript = stack[len(stack) - 1].Data
+	s.RedeemOps, err = parseScript(s.RedeemScript)
+	if err != nil {
+		return nil, false
+	}
+	
+	return s, true
+}
+
+// mightBeBare filters the inputs worth fetching the spent output for when looking for bare HTLCs:
+// inputs with a push only scriptSig and no witness which do not spend a P2PKH or P2SH output.
+func mightBeBare(in *txIn) (bool) {
+	if len(in.Witness) > 0 {
+		return false
+	}
+	
+	stack, err := parseScript(in.ScriptSig)
+	if err != nil || len(stack) == 0 {
+		return false
+	}
+	
+	for _, pop := range stack {
+		if pop.Opcode > txscript.OP_16 {
+			return false
+		}
+	}
+	
+	// P2PKH spends end with the public key
+	last := stack[len(stack) - 1].Data
+	if len(stack) == 2 && (len(last) == 33 || len(last) == 65) {
+		return false
+	}
+	
+	// P2SH spends end with a redeem script checking signatures
+	if redeemOps, err := parseScript(last); err == nil {
+		for _, pop := range redeemOps {
+			switch pop.Opcode {
+			case txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY, txscript.OP_CHECKMULTISIG, txscript.OP_CHECKMULTISIGVERIFY:
+				return false
+			}
+		}
+	}
+	
+	return true
+}
+
+// bareScript returns the spend of an input whose spent output holds the script directly.
+// The script is appended to the stack items, so it is the last one like the redeem script of a P2SH spend.
+func bareScript(in *txIn, prevOut *txOut) (*spend, bool) {
+	if len(in.Witness) > 0 {
+		return nil, false
+	}
+	
+	stack, err := parseScript(in.ScriptSig)
+	if err != nil {
+		return nil, false
+	}
+	
+	redeemOps, err := parseScript(prevOut.PkScript)
+	if err != nil {
+		return nil, false
+	}
+	
+	return &spend{
+		Stack: append(stack, pushOp(prevOut.PkScript)),
+		RedeemScript: prevOut.PkScript,
+		RedeemOps: redeemOps,
+		Type: spendBare,
+	}, true
+}
+
+func isPubkey(pops []parsedOp) (bool) {
+	return len(pops) == 2 &&
+		(len(pops[0].Data) == 33 || len(pops[0].Data) == 65) &&
+		pops[1].Opcode == txscript.OP_CHECKSIG
+}
+
+func isPubkeyHash(pops []parsedOp) (bool) {
+	return len(pops) == 5 &&
+		pops[0].Opcode == txscript.OP_DUP &&
+		pops[1].Opcode == txscript.OP_HASH160 &&
+		pops[2].Opcode == txscript.OP_DATA_20 &&
+		pops[3].Opcode == txscript.OP_EQUALVERIFY &&
+		pops[4].Opcode == txscript.OP_CHECKSIG
+}
+
+func isSmallInt(op byte) (bool) {
+	return op == txscript.OP_0 || (op >= txscript.OP_1 && op <= txscript.OP_16)
+}
+
+func isMultiSig(pops []parsedOp) (bool) {
+	length := len(pops)
+	if length < 4 {
+		return false
+	}
+	
+	if !isSmallInt(pops[0].Opcode) || !isSmallInt(pops[length - 2].Opcode) || pops[length - 1].Opcode != txscript.OP_CHECKMULTISIG {
+		return false
+	}
+	
+	for _, pop := range pops[1:length - 2] {
+		if len(pop.Data) != 33 && len(pop.Data) != 65 {
+			return false
+		}
+	}
+	
+	return true
+}
+
+func isNullData(pops []parsedOp) (bool) {
+	if len(pops) == 0 || pops[0].Opcode != txscript.OP_RETURN {
+		return false
+	}
+	
+	for _, pop := range pops[1:] {
+		if pop.Opcode > txscript.OP_16 {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// templateOp is an element of a script template, an opcode or a placeholder for pushed data
+type templateOp struct {
+	opcode byte
+	// push of this many bytes, -1 for any number (a small integer or a push of up to 5 bytes), 0 for the opcode
+	size   int
+}
+
+func tOp(opcode byte) templateOp {
+	return templateOp{opcode: opcode}
+}
+
+func tPush(size int) templateOp {
+	return templateOp{size: size}
+}
+
+var tNum = templateOp{size: -1}
+
+// matchTemplate checks if a script consists of the elements of a template
+func matchTemplate(pops []parsedOp, template []templateOp) (bool) {
+	if len(pops) != len(template) {
+		return false
+	}
+	
+	for i, t := range template {
+		pop := pops[i]
+		isPush := pop.Opcode <= txscript.OP_PUSHDATA4
+		
+		switch {
+		case t.size > 0:
+			if !isPush || len(pop.Data) != t.size {
+				return false
+			}
+		case t.size < 0:
+			if !isSmallInt(pop.Opcode) && !(isPush && len(pop.Data) <= 5) {
+				return false
+			}
+		default:
+			if pop.Opcode != t.opcode {
+				return false
+			}
+		}
+	}
+	
+	return true
+}
+
+// the scripts of lightning channels (BOLT 3), the htlc scripts of channels with anchors end with 1 OP_CHECKSEQUENCEVERIFY OP_DROP
+var (
+	lnOfferedHTLC = []templateOp{
+		tOp(txscript.OP_DUP), tOp(txscript.OP_HASH160), tPush(20), tOp(txscript.OP_EQUAL),
+		tOp(txscript.OP_IF),
+			tOp(txscript.OP_CHECKSIG),
+		tOp(txscript.OP_ELSE),
+			tPush(33), tOp(txscript.OP_SWAP), tOp(txscript.OP_SIZE), tNum, tOp(txscript.OP_EQUAL),
+			tOp(txscript.OP_NOTIF),
+				tOp(txscript.OP_DROP), tNum, tOp(txscript.OP_SWAP), tPush(33), tNum, tOp(txscript.OP_CHECKMULTISIG),
+			tOp(txscript.OP_ELSE),
+				tOp(txscript.OP_HASH160), tPush(20), tOp(txscript.OP_EQUALVERIFY),
+				tOp(txscript.OP_CHECKSIG),
+			tOp(txscript.OP_ENDIF),
+	}
+	lnReceivedHTLC = []templateOp{
+		tOp(txscript.OP_DUP), tOp(txscript.OP_HASH160), tPush(20), tOp(txscript.OP_EQUAL),
+		tOp(txscript.OP_IF),
+			tOp(txscript.OP_CHECKSIG),
+		tOp(txscript.OP_ELSE),
+			tPush(33), tOp(txscript.OP_SWAP), tOp(txscript.OP_SIZE), tNum, tOp(txscript.OP_EQUAL),
+			tOp(txscript.OP_IF),
+				tOp(txscript.OP_HASH160), tPush(20), tOp(txscript.OP_EQUALVERIFY),
+				tNum, tOp(txscript.OP_SWAP), tPush(33), tNum, tOp(txscript.OP_CHECKMULTISIG),
+			tOp(txscript.OP_ELSE),
+				tOp(txscript.OP_DROP), tNum, tOp(txscript.OP_CHECKLOCKTIMEVERIFY), tOp(txscript.OP_DROP),
+				tOp(txscript.OP_CHECKSIG),
+			tOp(txscript.OP_ENDIF),
+	}
+	lnHTLCEnd = []templateOp{
+		tOp(txscript.OP_ENDIF),
+	}
+	lnAnchorHTLCEnd = []templateOp{
+		tOp(txscript.OP_1), tOp(txscript.OP_CHECKSEQUENCEVERIFY), tOp(txscript.OP_DROP),
+		tOp(txscript.OP_ENDIF),
+	}
+	lnToLocal = []templateOp{
+		tOp(txscript.OP_IF),
+			tPush(33),
+		tOp(txscript.OP_ELSE),
+			tNum, tOp(txscript.OP_CHECKSEQUENCEVERIFY), tOp(txscript.OP_DROP),
+			tPush(33),
+		tOp(txscript.OP_ENDIF),
+		tOp(txscript.OP_CHECKSIG),
+	}
+	lnAnchor = []templateOp{
+		tPush(33), tOp(txscript.OP_CHECKSIG), tOp(txscript.OP_IFDUP),
+		tOp(txscript.OP_NOTIF),
+			tOp(txscript.OP_16), tOp(txscript.OP_CHECKSEQUENCEVERIFY),
+		tOp(txscript.OP_ENDIF),
+	}
+)
+
+// lightningScript returns the kind of a script of a lightning channel (offered-htlc, received-htlc, to-local
+// or anchor) or an empty string for other scripts
+func lightningScript(pops []parsedOp) (string) {
+	join := func(a, b []templateOp) []templateOp {
+		return append(append([]templateOp{}, a...), b...)
+	}
+	
+	switch {
+	case matchTemplate(pops, join(lnOfferedHTLC, lnHTLCEnd)), matchTemplate(pops, join(lnOfferedHTLC, lnAnchorHTLCEnd)):
+		return "offered-htlc"
+	case matchTemplate(pops, join(lnReceivedHTLC, lnHTLCEnd)), matchTemplate(pops, join(lnReceivedHTLC, lnAnchorHTLCEnd)):
+		return "received-htlc"
+	case matchTemplate(pops, lnToLocal):
+		return "to-local"
+	case matchTemplate(pops, lnAnchor):
+		return "anchor"
+	}
+	
+	return ""
+}
+
+// rule is a detection rule of the rules file (rules.json). The script executed by an input is a candidate
+// if it matches at least one rule. Opcodes are given by name, e.g. OP_CHECKLOCKTIMEVERIFY or OP_DATA_20.
+type rule struct {
+	Name        string     `json:"name"`
+	// the kind of contract, e.g. htlc or hashlock-multisig
+	Family      string     `json:"family"`
+	// the rule is only used if it is named by -enable
+	Disabled    bool       `json:"disabled"`
+	// the rule only applies to these spend types (p2sh, p2wsh, p2sh-p2wsh, p2tr, bare), to all if empty
+	SpendTypes  []string   `json:"spend_types"`
+	// standard scripts (pubkey, pubkey hash, multisig and null data) do not match
+	NonStandard bool       `json:"non_standard"`
+	// a tapscript leaf must have a sibling in the tree, e.g. because the other half of the HTLC is hidden there
+	Sibling     bool       `json:"sibling"`
+	// every set needs at least one of its opcodes in the script
+	Required    [][]string `json:"required"`
+	// none of these opcodes may be in the script
+	Forbidden   []string   `json:"forbidden"`
+	// these opcodes have to be in the script in this order, other opcodes may be in between
+	Sequence    []string   `json:"sequence"`
+	// the script has to contain one opcode of each set right after each other, e.g. a hash opcode,
+	// the push of the hash and OP_EQUAL
+	Pattern     [][]string `json:"pattern"`
+	Pushes      []pushRule `json:"pushes"`
+	
+	required  [][]byte
+	forbidden []byte
+	sequence  []byte
+	pattern   [][]byte
+}
+
+// pushRule limits the number of data pushes with one of the given sizes
+type pushRule struct {
+	// sizes of the pushed data in bytes
+	Sizes []int `json:"sizes"`
+	Min   int   `json:"min"`
+	// no limit if 0
+	Max   int   `json:"max"`
+}
+
+// chainOpcodes returns the opcodes of the chain c by name, opcodes with another meaning on c (see
+// registry.Chain.Opcodes) are named by that meaning
+func chainOpcodes(c *registry.Chain) map[string]byte {
+	opcodeByName := make(map[string]byte)
+	for name, op := range txscript.OpcodeByName {
+		if _, renamed := c.Opcodes[name]; !renamed {
+			opcodeByName[name] = op
+		}
+	}
+	for name, meaning := range c.Opcodes {
+		opcodeByName[meaning] = txscript.OpcodeByName[name]
+	}
+	
+	return opcodeByName
+}
+
+// readPoolSpends looks up the opcodes of the pool spends of the chain c
+func readPoolSpends(c *registry.Chain) (map[byte]bool, error) {
+	opcodeByName := chainOpcodes(c)
+	
+	ops := make(map[byte]bool)
+	for _, name := range c.PoolSpends {
+		op, ok := opcodeByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %s in the pool spends of %s", name, c.Name)
+		}
+		ops[op] = true
+	}
+	
+	return ops, nil
+}
+
+// isPoolSpend tells whether an input takes value out of a pool of the chain (e.g. a sigma spend of zcoin)
+// instead of spending an output
+func isPoolSpend(in *txIn) bool {
+	return len(in.ScriptSig) > 0 && poolSpends[in.ScriptSig[0]]
+}
+
+// readRules reads the detection rules and looks up their opcodes on the chain c. Opcodes with another
+// meaning on c (see registry.Chain.Opcodes) are looked up by that meaning, e.g. OP_SHA256 is 0xc0 on decred.
+// Opcodes which only exist on other chains of the registry are left out.
+func readRules(fileName string, c *registry.Chain, chains []*registry.Chain) ([]*rule, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	
+	var rules []*rule
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	
+	// the opcodes of this chain by name and the names only known on other chains
+	opcodeByName := chainOpcodes(c)
+	otherChains := make(map[string]bool)
+	for _, other := range chains {
+		for name, meaning := range other.Opcodes {
+			otherChains[name] = true
+			otherChains[meaning] = true
+		}
+	}
+	
+	opcodes := func(r *rule, names []string) ([]byte, error) {
+		ops := make([]byte, 0, len(names))
+		for _, name := range names {
+			op, ok := opcodeByName[name]
+			if !ok && otherChains[name] {
+				continue
+			}
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown opcode %s in rule %s", fileName, name, r.Name)
+			}
+			ops = append(ops, op)
+		}
+		return ops, nil
+	}
+	
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%s: rule without name", fileName)
+		}
+		if r.Family == "" {
+			r.Family = "htlc"
+		}
+		
+		for _, names := range r.Required {
+			ops, err := opcodes(r, names)
+			if err != nil {
+				return nil, err
+			}
+			r.required = append(r.required, ops)
+		}
+		if r.forbidden, err = opcodes(r, r.Forbidden); err != nil {
+			return nil, err
+		}
+		if r.sequence, err = opcodes(r, r.Sequence); err != nil {
+			return nil, err
+		}
+		for _, names := range r.Pattern {
+			ops, err := opcodes(r, names)
+			if err != nil {
+				return nil, err
+			}
+			r.pattern = append(r.pattern, ops)
+		}
+	}
+	
+	return rules, nil
+}
+
+// match checks if the script executed by an input matches the rule
+func (r *rule) match(s *spend) (bool) {
+	pops := s.RedeemOps
+	
+	if len(r.SpendTypes) > 0 {
+		found := false
+		for _, spendType := range r.SpendTypes {
+			found = found || spendType == s.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	
+	if r.NonStandard && (isPubkey(pops) || isPubkeyHash(pops) || isMultiSig(pops) || isNullData(pops)) {
+		return false
+	}
+	
+	if r.Sibling && (s.ControlBlock == nil || len(s.ControlBlock.InclusionProof) < txscript.ControlBlockNodeSize) {
+		return false
+	}
+	
+	contains := func(ops []byte, op byte) (bool) {
+		return bytes.IndexByte(ops, op) >= 0
+	}
+	
+	found := make([]bool, len(r.required))
+	next := 0
+	for _, pop := range pops {
+		if contains(r.forbidden, pop.Opcode) {
+			return false
+		}
+		
+		for i, ops := range r.required {
+			found[i] = found[i] || contains(ops, pop.Opcode)
+		}
+		
+		if next < len(r.sequence) && pop.Opcode == r.sequence[next] {
+			next++
+		}
+	}
+	
+	for _, ok := range found {
+		if !ok {
+			return false
+		}
+	}
+	
+	if next < len(r.sequence) {
+		return false
+	}
+	
+	if len(r.pattern) > 0 {
+		found := false
+		for start := 0; !found && start + len(r.pattern) <= len(pops); start++ {
+			found = true
+			for i, ops := range r.pattern {
+				if !contains(ops, pops[start + i].Opcode) {
+					found = false
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	
+	for _, p := range r.Pushes {
+		count := 0
+		for _, pop := range pops {
+			if pop.Opcode > txscript.OP_PUSHDATA4 {
+				continue
+			}
+			for _, size := range p.Sizes {
+				if len(pop.Data) == size {
+					count++
+					break
+				}
+			}
+		}
+		
+		if count < p.Min || (p.Max > 0 && count > p.Max) {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// matchRules returns the rules matched by the script executed by an input
+func matchRules(s *spend) ([]*rule) {
+	var matched []*rule
+	
+	for _, r := range rules {
+		if r.match(s) {
+			matched = append(matched, r)
+		}
+	}
+	
+	return matched
+}
+
+// isRefund checks if an input takes the else branch of a script (i.e. its last push before the script is false)
+// and the transaction has a locktime which is enforced for the input, like the presigned refunds of hashlock-multisig swaps
+func isRefund(s *spend, tx *transaction, in *txIn) (bool) {
+	// the locktime is ignored if the sequence of the input is final
+	if tx.LockTime == 0 || in.Sequence == wire.MaxTxInSequenceNum || len(s.Stack) < 2 {
+		return false
+	}
+	
+	selector := s.Stack[len(s.Stack) - 2]
+	return selector.Opcode == txscript.OP_0 || (selector.Opcode <= txscript.OP_PUSHDATA4 && len(selector.Data) == 0)
+}
+
+// checkpoint is the progress of a scan, it is saved after every block
+type checkpoint struct {
+	From    int64  `json:"from"`
+	To      int64  `json:"to"`
+	Forward bool   `json:"forward"`
+	// the last block whose candidates are written to the output
+	Height  int64  `json:"height"`
+	Hash    string `json:"hash"`
+	// the size of the output when the checkpoint was written, anything behind it was written after
+	Offset  int64  `json:"offset"`
+	// the parts of the range which are not written to the output yet, in scan order
+	Ranges  []*scanRange `json:"ranges,omitempty"`
+	// the last blocks processed by -follow, to detect reorganisations
+	Follow  []*followedBlock `json:"follow,omitempty"`
+}
+
+// followedBlock is a block processed by -follow
+type followedBlock struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+	// the size of the output before the candidates of this block, -1 for the block following started at
+	Offset int64  `json:"offset"`
+}
+
+// scanRange is a part of the scanned range which is processed by a single worker
+type scanRange struct {
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	// the last block which was processed completely
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+	// the size of the part file
+	Offset int64  `json:"offset"`
+	Done   bool   `json:"done"`
+}
+
+// startAt moves the start of the checkpoint up to the block from, the parts and the progress of a forward
+// scan below it are dropped
+func (cp *checkpoint) startAt(from int64) {
+	if cp.From >= from {
+		return
+	}
+	cp.From = from
+	
+	if cp.Forward && cp.Height < from {
+		cp.Height = 0
+		cp.Hash = ""
+	}
+	
+	ranges := cp.Ranges[:0]
+	for _, r := range cp.Ranges {
+		if r.To < from {
+			continue
+		}
+		if r.From < from {
+			r.From = from
+		}
+		if cp.Forward && r.Hash != "" && r.Height < from {
+			r.Height = 0
+			r.Hash = ""
+		}
+		ranges = append(ranges, r)
+	}
+	cp.Ranges = ranges
+}
+
+// readCheckpoint reads the checkpoint file, if there is none it returns nil
+func readCheckpoint(fileName string) (*checkpoint, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	cp := new(checkpoint)
+	if err := json.Unmarshal(raw, cp); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %s: %v", fileName, err)
+	}
+	
+	return cp, nil
+}
+
+// readLegacyCheckpoint reads the height files of older versions (e.g. blockBTC.txt), which always scanned backwards.
+// Heights below 10000 meant starting at the best block, so there is nothing to continue.
+func readLegacyCheckpoint(fileName string, lowestBlock int64) (*checkpoint, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	legacyHeight, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	
+	if legacyHeight < 10000 {
+		return nil, nil
+	}
+	
+	// the height was written after the block was processed, but older versions processed it again
+	return &checkpoint{
+		From: lowestBlock,
+		To: legacyHeight,
+		Height: legacyHeight,
+	}, nil
+}
+
+// writeCheckpoint saves the checkpoint, the file is replaced at once so it is never half written
+func writeCheckpoint(fileName string, cp *checkpoint) error {
+	raw, err := json.MarshalIndent(cp, "", "\t")
+	if err != nil {
+		return err
+	}
+	
+	tmpFileName := fileName + ".tmp"
+	f, err := os.Create(tmpFileName)
+	if err != nil {
+		return err
+	}
+	
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return err
+	}
+	
+	// the checkpoint must not be renamed before it is on disk
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	
+	if err := f.Close(); err != nil {
+		return err
+	}
+	
+	return os.Rename(tmpFileName, fileName)
+}
+
+// resolveHeight turns a block height or a date into a height. For the upper end of a range a date
+// resolves to the last block before it, otherwise to the first block at or after it.
+func resolveHeight(ctx context.Context, src blockSource, value string, bestHeight int64, upper bool) (int64, error) {
+	if h, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return h, nil
+	}
+	
+	var (
+		t   time.Time
+		err error
+	)
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err = time.Parse(layout, value); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a height nor a date", value)
+	}
+	
+	h, err := heightAtTime(ctx, src, t, bestHeight)
+	if err != nil {
+		return 0, err
+	}
+	
+	if upper {
+		h--
+	}
+	
+	return h, nil
+}
+
+// resolveRange sets the range of scan to the heights or dates from and to, the ends which are empty are kept
+func resolveRange(ctx context.Context, src blockSource, from, to string, bestHeight int64, scan *checkpoint) error {
+	var err error
+	if from != "" {
+		if scan.From, err = resolveHeight(ctx, src, from, bestHeight, false); err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		if scan.To, err = resolveHeight(ctx, src, to, bestHeight, true); err != nil {
+			return err
+		}
+	}
+	
+	// e.g. reversed dates or two dates without a block between them
+	if from != "" && to != "" && scan.From > scan.To {
+		return fmt.Errorf("no blocks from %s to %s (heights %d to %d)", from, to, scan.From, scan.To)
+	}
+	
+	return nil
+}
+
+// heightAtTime returns the height of the first block with a timestamp not before t using a binary search.
+// Block timestamps are not strictly increasing, but close enough for choosing a range.
+func heightAtTime(ctx context.Context, src blockSource, t time.Time, bestHeight int64) (int64, error) {
+	lo, hi := int64(0), bestHeight + 1
+	
+	for lo < hi {
+		mid := (lo + hi) / 2
+		
+		h, err := src.BlockHash(ctx, mid)
+		if err != nil {
+			return 0, err
+		}
+		
+		// only the time is needed, so the transactions are neither fetched nor cached
+		b, err := src.BlockHeader(ctx, h)
+		if err != nil {
+			return 0, err
+		}
+		
+		if b.Time < t.Unix() {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	
+	return lo, nil
+}
+
+// splitRange splits a range into parts of size blocks in scan order
+func splitRange(from, to int64, forward bool, size int64) ([]*scanRange) {
+	var ranges []*scanRange
+	
+	if size < 1 {
+		size = 1
+	}
+	
+	if forward {
+		for start := from; start <= to; start += size {
+			end := start + size - 1
+			if end > to {
+				end = to
+			}
+			ranges = append(ranges, &scanRange{From: start, To: end})
+		}
+	} else {
+		for end := to; end >= from; end -= size {
+			start := end - size + 1
+			if start < from {
+				start = from
+			}
+			ranges = append(ranges, &scanRange{From: start, To: end})
+		}
+	}
+	
+	return ranges
+}
+
+// findHTLCs checks all inputs of a block for HTLCs and returns the candidates in the order of the block
+func findHTLCs(ctx context.Context, src blockSource, block *block) ([]*candidate, error) {
+	var candidates []*candidate
+	
+	// walk all transactions
+	for _, tx := range block.Tx {
+		txCandidates, err := findTxHTLCs(ctx, src, block, tx)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, txCandidates...)
+	}
+	
+	return candidates, nil
+}
+
+// findTxHTLCs returns the inputs of a transaction of block which spend an HTLC.
+// For unconfirmed transactions block only has the time the transaction was seen.
+func findTxHTLCs(ctx context.Context, src blockSource, block *block, tx *transaction) ([]*candidate, error) {
+	var (
+		candidates []*candidate
+		fee        *float64
+		feeDone    bool
+	)
+	
+	// check inputs
+	// walk all tx inputs
+	for index, in := range tx.Vin {
+		
+		// neither a coinbase nor a pool spend has a spent output
+		if in.Coinbase || isPoolSpend(in) {
+			continue
+		}
+		
+		var (
+			prevOut *txOut
+			matched []*rule
+			err     error
+		)
+		
+		// get the executed script from the scriptSig or the witness
+		thisSpend, ok := redeemScript(in)
+		if ok {
+			matched = matchRules(thisSpend)
+		}
+		
+		// otherwise the HTLC might be the script of the spent output itself
+		if len(matched) == 0 && (in.PrevOut != nil || (bare && mightBeBare(in))) {
+			prevOut, err = src.PrevOut(ctx, in)
+			if err != nil {
+				return nil, err
+			}
+			
+			if thisSpend, ok = bareScript(in, prevOut); ok && prevOut.Version == 0 {
+				matched = matchRules(thisSpend)
+			}
+		}
+		
+		if len(matched) == 0 {
+			continue
+		}
+		
+		inputTx := in.Txid
+		
+		if prevOut == nil {
+			prevOut, err = src.PrevOut(ctx, in)
+			if err != nil {
+				return nil, err
+			}
+		}
+		
+		// scripts of other versions than 0 (decred) have no defined meaning yet
+		if prevOut.Version != 0 {
+			log.Debugf("ignoring script version %d in Tx: %s", prevOut.Version, tx.Txid)
+			continue
+		}
+		
+		log.Infof("      Found timelock in Tx: %s", tx.Txid)
+		
+		// blinded values are unknown and stay 0
+		inputValue := btcutil.Amount(prevOut.Value).ToBTC()
+		
+		// the fee needs all spent outputs, so it is only calculated for transactions with candidates
+		// and only if they are known without further requests
+		if !feeDone {
+			if txFee, ok := transactionFee(src, tx); ok {
+				value := btcutil.Amount(txFee).ToBTC()
+				fee = &value
+			}
+			feeDone = true
+		}
+		
+		thisCandidate := new(candidate)
+		
+		*thisCandidate = candidate {
+			Block: block.Height,
+			BlockHash: block.Hash,
+			Timestamp: time.Unix(block.Time, 0).UTC().String(),
+			Transaction: tx.Txid,
+			Version: tx.Version,
+			LockTime: tx.LockTime,
+			Fee: fee,
+			VSize: tx.VSize,
+			Expiry: tx.Expiry,
+			Tree: tx.Tree,
+			InputIndex: index,
+			Sequence: in.Sequence,
+			InputTx: inputTx,
+			InputVout: in.Vout,
+			InputValue: inputValue,
+			Asset: prevOut.Asset,
+			Blinded: prevOut.Blinded,
+			PrevScript: hex.EncodeToString(prevOut.PkScript),
+			Asm: disasm(thisSpend.Stack),
+			SpendType: thisSpend.Type,
+			Family: matched[0].Family,
+		}
+		
+		for _, r := range matched {
+			thisCandidate.Rules = append(thisCandidate.Rules, r.Name)
+		}
+		
+		thisCandidate.Lightning = lightningScript(thisSpend.RedeemOps)
+		
+		// hashlock-multisig swaps are refunded by a presigned transaction with a locktime,
+		// which is linked to the output funding the swap
+		if thisCandidate.Family == "hashlock-multisig" && isRefund(thisSpend, tx, in) {
+			thisCandidate.Refund = true
+			thisCandidate.Funding = outPointKey(inputTx, in.Vout)
+		}
+		
+		// the leaf version, internal key and merkle path of a tapscript leaf
+		if cb := thisSpend.ControlBlock; cb != nil {
+			thisCandidate.LeafVersion = int(cb.LeafVersion)
+			thisCandidate.InternalKey = hex.EncodeToString(schnorr.SerializePubKey(cb.InternalKey))
+			for i := 0; i < len(cb.InclusionProof); i += txscript.ControlBlockNodeSize {
+				thisCandidate.MerklePath = append(thisCandidate.MerklePath, hex.EncodeToString(cb.InclusionProof[i:i + txscript.ControlBlockNodeSize]))
+			}
+		}
+		
+		candidates = append(candidates, thisCandidate)
+	}
+	
+	return candidates, nil
+}
+
+// transactionFee returns the fee of a transaction in the smallest unit. Spent outputs are only taken from
+// the transaction (getblock verbosity 3, undo data, esplora) or from the cache, false if one of them is unknown.
+func transactionFee(src blockSource, tx *transaction) (int64, bool) {
+	var fee int64
+	
+	// the other values of elements may be blinded or of other assets
+	if feeOutputs {
+		for _, out := range tx.Vout {
+			if len(out.PkScript) == 0 && !out.Blinded {
+				fee += out.Value
+			}
+		}
+		return fee, true
+	}
+	
+	cache, _ := src.(*cachedSource)
+	for _, in := range tx.Vin {
+		if in.Coinbase {
+			return 0, true
+		}
+		// the value taken out of the pool is not known
+		if isPoolSpend(in) {
+			return 0, false
+		}
+		
+		prevOut := in.PrevOut
+		if prevOut == nil && cache != nil {
+			prevOut = cache.cachedPrevOut(in)
+		}
+		if prevOut == nil {
+			return 0, false
+		}
+		fee += prevOut.Value
+	}
+	
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	
+	// value taken out of the shielded pools of zcash pays for the fee as well
+	fee += tx.ValueBalanceSapling + tx.ValueBalanceOrchard + tx.VPubNew - tx.VPubOld
+	
+	return fee, true
+}
+
+// scanner hands out the ranges of a scan to the workers. Each worker writes the candidates of its range
+// to a part file, finished parts are appended to the output in scan order.
+type scanner struct {
+	src        blockSource
+	scan       *checkpoint
+	cpFileName string
+	partDir    string
+	out        *os.File
+	// the inputs of the candidates in the output which may be found again (see replayable), with their block
+	seen       map[string]int64
+	mu         sync.Mutex
+	next       int
+	// the unconfirmed candidates while following the tip, nil if they are not wanted
+	mempool    *mempool
+	// serialization of the announced transactions (see registry.Chain.Wire)
+	wire       string
+}
+
+// nextRange returns the next range which is not processed yet
+func (s *scanner) nextRange() (*scanRange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	for ; s.next < len(s.scan.Ranges); s.next++ {
+		if !s.scan.Ranges[s.next].Done {
+			s.next++
+			return s.scan.Ranges[s.next - 1]
+		}
+	}
+	
+	return nil
+}
+
+func (s *scanner) partFileName(r *scanRange) (string) {
+	return filepath.Join(s.partDir, fmt.Sprintf("%d-%d.json", r.From, r.To))
+}
+
+// run processes all ranges with the given number of workers
+func (s *scanner) run(ctx context.Context, workers int) error {
+	if err := os.MkdirAll(s.partDir, 0755); err != nil {
+		return err
+	}
+	
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := s.nextRange(); r != nil && ctx.Err() == nil; r = s.nextRange() {
+				if err := s.scanRange(ctx, r); err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	
+	if firstErr != nil {
+		return firstErr
+	}
+	
+	// ranges finished by an earlier run
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.merge()
+}
+
+// scanRange processes the blocks of a range and writes the candidates to its part file
+func (s *scanner) scanRange(ctx context.Context, r *scanRange) error {
+	step := int64(-1)
+	height := r.To
+	if s.scan.Forward {
+		step = 1
+		height = r.From
+	}
+	
+	// continue where the range stopped
+	if r.Hash != "" {
+		h, err := s.src.BlockHash(ctx, r.Height)
+		if err == nil && h.String() == r.Hash {
+			height = r.Height + step
+		} else {
+			// the block was replaced by a reorganisation, so its candidates are removed and it is scanned again
+			log.Infof("warning: block %d of the checkpoint is not part of the chain anymore\n", r.Height)
+			height = r.Height
+			
+			start, err := blockStart(s.partFileName(r), r.Offset, r.Height)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			r.Offset = start
+			s.mu.Unlock()
+		}
+	}
+	
+	// anything behind the offset of the range was written after its last checkpoint
+	part, err := openTruncated(s.partFileName(r), r.Offset)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	
+	offset := r.Offset
+	
+	// the hash of the next block is taken from the current one, if unknown it is looked up by height
+	var h *chainhash.Hash
+	
+	// process all blocks of the range
+	for ; height >= r.From && height <= r.To; height += step {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		if h == nil {
+			if h, err = s.src.BlockHash(ctx, height); err != nil {
+				return fmt.Errorf("error getting block hash for height %d: %v", height, err)
+			}
+		}
+		
+		// get a block with all transactions
+		block, err := s.src.Block(ctx, h)
+		if err != nil {
+			return fmt.Errorf("error fetching block: %v", err)
+		}
+		if block.Height != height {
+			log.Infof("warning: block height mismatch exp=%d got=%d\n", height, block.Height)
+		}
+		
+		// follow the chain in the scan direction
+		next := block.PreviousHash
+		if s.scan.Forward {
+			next = block.NextHash
+		}
+		h = nil
+		if next != "" {
+			if h, err = chainhash.NewHashFromStr(next); err != nil {
+				log.Infof("error getting next block hash from %s: %v", next, err)
+				h = nil
+			}
+		}
+		
+		// skip genesis block transactions
+		if height != 0 {
+			candidates, err := findHTLCs(ctx, s.src, block)
+			if err != nil {
+				return err
+			}
+			
+			// write the candidates of the block at once and make sure they are on disk before the checkpoint
+			if len(candidates) > 0 {
+				raw, err := encodeCandidates(candidates)
+				if err != nil {
+					return err
+				}
+				if _, err := part.Write(raw); err != nil {
+					return err
+				}
+				if err := part.Sync(); err != nil {
+					return err
+				}
+				offset += int64(len(raw))
+			}
+		}
+		
+		log.Infof("Block %6d: %s (%d)\tsize=%d\tn_tx=%d\n",
+			height,
+			time.Unix(block.Time, 0).UTC().String(),
+			block.Time,
+			block.Size,
+			len(block.Tx),
+		)
+		
+		// save the progress
+		s.mu.Lock()
+		r.Height = height
+		r.Hash = block.Hash
+		r.Offset = offset
+		err = writeCheckpoint(s.cpFileName, s.scan)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Done = true
+	
+	return s.merge()
+}
+
+// merge appends the finished ranges at the beginning of the scan to the output.
+// Candidates which are in the output already (e.g. from scanning a range twice) are skipped.
+// The caller must hold s.mu.
+func (s *scanner) merge() error {
+	for len(s.scan.Ranges) > 0 && s.scan.Ranges[0].Done {
+		r := s.scan.Ranges[0]
+		
+		candidates, _, err := readCandidates(s.partFileName(r))
+		if err != nil {
+			return err
+		}
+		
+		if err := s.write(candidates); err != nil {
+			return err
+		}
+		
+		if r.Hash != "" {
+			s.scan.Height = r.Height
+			s.scan.Hash = r.Hash
+		}
+		s.scan.Ranges = s.scan.Ranges[1:]
+		if s.next > 0 {
+			s.next--
+		}
+		s.prune()
+		
+		if err := writeCheckpoint(s.cpFileName, s.scan); err != nil {
+			return err
+		}
+		
+		if err := os.Remove(s.partFileName(r)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// write appends the candidates which are not in the output yet to it.
+// The candidates have to be on disk before the checkpoint moves the offset behind them.
+// The caller must hold s.mu.
+func (s *scanner) write(candidates []*candidate) error {
+	var newCandidates []*candidate
+	for _, c := range candidates {
+		key := inputKey(c.Transaction, c.InputIndex)
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+		if s.replayable(c.Block) {
+			s.seen[key] = c.Block
+		}
+		newCandidates = append(newCandidates, c)
+	}
+	
+	if len(newCandidates) == 0 {
+		return nil
+	}
+	
+	raw, err := encodeCandidates(newCandidates)
+	if err != nil {
+		return err
+	}
+	if _, err := s.out.Write(raw); err != nil {
+		return err
+	}
+	if err := s.out.Sync(); err != nil {
+		return err
+	}
+	s.scan.Offset += int64(len(raw))
+	
+	return nil
+}
+
+// inputKey identifies the input of a candidate
+func inputKey(txid string, index int) string {
+	return txid + ":" + strconv.Itoa(index)
+}
+
+// replayable tells whether the candidates of the block at height may be found again: blocks of the ranges
+// which are not merged yet (e.g. of an earlier output which overlaps the range) and the followed blocks,
+// which are processed again after a reorganisation
+func (s *scanner) replayable(height int64) bool {
+	if len(s.scan.Follow) > 0 {
+		if height >= s.scan.Follow[0].Height {
+			return true
+		}
+	} else if height > s.scan.To {
+		return true
+	}
+	
+	for _, r := range s.scan.Ranges {
+		if height >= r.From && height <= r.To {
+			return true
+		}
+	}
+	
+	return false
+}
+
+// prune forgets the inputs of candidates which can not be found again
+func (s *scanner) prune() {
+	for key, height := range s.seen {
+		if !s.replayable(height) {
+			delete(s.seen, key)
+		}
+	}
+}
+
+// retract removes everything behind offset from the output, e.g. the candidates of orphaned blocks.
+// The caller must hold s.mu.
+func (s *scanner) retract(offset int64) error {
+	raw, err := ioutil.ReadFile(s.out.Name())
+	if err != nil {
+		return err
+	}
+	if int64(len(raw)) < offset {
+		return fmt.Errorf("%s is shorter than %d bytes", s.out.Name(), offset)
+	}
+	
+	// the retracted candidates may be written again
+	for _, line := range bytes.Split(raw[offset:], []byte{'\n'}) {
+		c := new(candidate)
+		if json.Unmarshal(line, c) != nil {
+			continue
+		}
+		delete(s.seen, inputKey(c.Transaction, c.InputIndex))
+	}
+	
+	if err := s.out.Truncate(offset); err != nil {
+		return err
+	}
+	if err := s.out.Sync(); err != nil {
+		return err
+	}
+	s.scan.Offset = offset
+	
+	return nil
+}
+
+// follow processes new blocks at the tip of the chain as they arrive, it only returns on errors.
+// It checks for new blocks on every signal of blocks and at least every interval.
+// The last followed blocks are kept in the checkpoint to detect reorganisations.
+// With a mempool the unconfirmed transactions are checked as well, txs are raw transactions announced by the node.
+func (s *scanner) follow(ctx context.Context, blocks <-chan struct{}, txs <-chan []byte, interval time.Duration, depth int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	// start at the top of the scanned range
+	if len(s.scan.Follow) == 0 {
+		if err := s.anchor(ctx, s.scan.To); err != nil {
+			return err
+		}
+	}
+	
+	for {
+		if err := s.followTip(ctx, depth); err != nil {
+			return err
+		}
+		
+		if s.mempool != nil {
+			if err := s.mempool.update(ctx, s.src); err != nil {
+				return err
+			}
+			if err := s.mempool.write(); err != nil {
+				return err
+			}
+		}
+		
+		if err := s.wait(ctx, blocks, txs, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// wait returns when there might be a new block, announced transactions are checked meanwhile.
+// The caller must hold s.mu, it is released while waiting.
+func (s *scanner) wait(ctx context.Context, blocks <-chan struct{}, txs <-chan []byte, interval time.Duration) error {
+	timeout := time.After(interval)
+	
+	for {
+		s.mu.Unlock()
+		var raw []byte
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		case <-blocks:
+			s.mu.Lock()
+			return nil
+		case <-timeout:
+			s.mu.Lock()
+			return nil
+		case raw = <-txs:
+		}
+		s.mu.Lock()
+		
+		// transactions which can not be decoded (e.g. with MWEB data) or whose txid is unknown (zcash v5)
+		// are fetched from the node by the next poll of the mempool
+		tx, err := decodeTx(s.wire, raw)
+		if err != nil || tx.Txid == "" {
+			log.Debugf("announced transaction left to the next poll: %v\n", err)
+			continue
+		}
+		
+		if err := s.mempool.check(ctx, s.src, tx); err != nil {
+			return err
+		}
+		if err := s.mempool.write(); err != nil {
+			return err
+		}
+	}
+}
+
+// mempool keeps the candidates of unconfirmed transactions. They are written to their own file which is
+// replaced on every change, a candidate is removed when its transaction is mined (and written to the
+// output with the block) or evicted.
+type mempool struct {
+	fileName string
+	// the candidates of unconfirmed transactions by txid
+	pending  map[string][]*candidate
+	// the transactions in the mempool which were checked already
+	checked  map[string]bool
+	changed  bool
+}
+
+func newMempool(fileName string) *mempool {
+	return &mempool{
+		fileName: fileName,
+		pending: make(map[string][]*candidate),
+		checked: make(map[string]bool),
+	}
+}
+
+// check looks for HTLCs in an unconfirmed transaction
+func (m *mempool) check(ctx context.Context, src blockSource, tx *transaction) error {
+	if m.checked[tx.Txid] {
+		return nil
+	}
+	m.checked[tx.Txid] = true
+	
+	// the time the transaction was seen is the timestamp until it is mined
+	candidates, err := findTxHTLCs(ctx, src, &block{Time: time.Now().Unix()}, tx)
+	if err != nil {
+		// e.g. a spent output of a transaction which was replaced meanwhile, it is checked again when mined
+		log.Infof("warning: unconfirmed transaction %s: %v\n", tx.Txid, err)
+		return nil
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	
+	for _, c := range candidates {
+		c.Unconfirmed = true
+	}
+	
+	log.Infof("unconfirmed transaction %s, %d candidates\n", tx.Txid, len(candidates))
+	
+	m.pending[tx.Txid] = candidates
+	m.changed = true
+	
+	return nil
+}
+
+// confirm removes the candidates of the transactions of a block, they are written to the output with the block
+func (m *mempool) confirm(block *block) {
+	for _, tx := range block.Tx {
+		delete(m.checked, tx.Txid)
+		
+		if _, ok := m.pending[tx.Txid]; ok {
+			log.Infof("unconfirmed transaction %s was mined in block %d\n", tx.Txid, block.Height)
+			delete(m.pending, tx.Txid)
+			m.changed = true
+		}
+	}
+}
+
+// update checks the transactions in the mempool of the node and drops the candidates of evicted ones
+func (m *mempool) update(ctx context.Context, src blockSource) error {
+	txids, err := src.Mempool(ctx)
+	if err != nil {
+		return err
+	}
+	
+	inMempool := make(map[string]bool)
+	var unchecked []*chainhash.Hash
+	for _, txid := range txids {
+		inMempool[txid.String()] = true
+		if !m.checked[txid.String()] {
+			unchecked = append(unchecked, txid)
+		}
+	}
+	
+	// the whole mempool is unchecked on the first poll
+	for len(unchecked) > 0 {
+		n := len(unchecked)
+		if n > mempoolBatchSize {
+			n = mempoolBatchSize
+		}
+		
+		txs, err := fetchTransactions(ctx, src, unchecked[:n])
+		if err != nil {
+			return err
+		}
+		unchecked = unchecked[n:]
+		
+		for _, tx := range txs {
+			// the transaction was mined or evicted in the meantime
+			if tx == nil {
+				continue
+			}
+			if err := m.check(ctx, src, tx); err != nil {
+				return err
+			}
+		}
+	}
+	
+	// mined transactions were removed with their block already
+	for txid := range m.checked {
+		if inMempool[txid] {
+			continue
+		}
+		
+		delete(m.checked, txid)
+		if _, ok := m.pending[txid]; ok {
+			log.Infof("unconfirmed transaction %s was evicted\n", txid)
+			delete(m.pending, txid)
+			m.changed = true
+		}
+	}
+	
+	return nil
+}
+
+// mempoolBatchSize is the number of unconfirmed transactions requested at once
+const mempoolBatchSize = 500
+
+// batchSource is implemented by sources which fetch many transactions with one request
+type batchSource interface {
+	// Transactions returns the transactions of txids, nil for the ones which are not found
+	Transactions(ctx context.Context, txids []*chainhash.Hash) ([]*transaction, error)
+}
+
+// fetchTransactions fetches the transactions of txids at once if src is a batchSource, one by one otherwise.
+// Transactions which are not found are nil.
+func fetchTransactions(ctx context.Context, src blockSource, txids []*chainhash.Hash) ([]*transaction, error) {
+	// the cache only keeps outputs of blocks
+	if cache, ok := src.(*cachedSource); ok {
+		src = cache.blockSource
+	}
+	if batch, ok := src.(batchSource); ok {
+		return batch.Transactions(ctx, txids)
+	}
+	
+	txs := make([]*transaction, len(txids))
+	for i, txid := range txids {
+		tx, err := src.Transaction(ctx, txid)
+		if err != nil {
+			log.Debugf("unconfirmed transaction %s: %v\n", txid, err)
+			continue
+		}
+		txs[i] = tx
+	}
+	
+	return txs, nil
+}
+
+// write replaces the file with the candidates of unconfirmed transactions if they changed
+func (m *mempool) write() error {
+	if !m.changed {
+		return nil
+	}
+	
+	txids := make([]string, 0, len(m.pending))
+	for txid := range m.pending {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	
+	var candidates []*candidate
+	for _, txid := range txids {
+		candidates = append(candidates, m.pending[txid]...)
+	}
+	
+	raw, err := encodeCandidates(candidates)
+	if err != nil {
+		return err
+	}
+	
+	if err := ioutil.WriteFile(m.fileName + ".tmp", raw, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(m.fileName + ".tmp", m.fileName); err != nil {
+		return err
+	}
+	
+	m.changed = false
+	
+	return nil
+}
+
+// blockNotifier tells about new blocks at the tip of the chain
+type blockNotifier interface {
+	// Run sends on blocks for every new block until ctx is done or the connection fails
+	Run(ctx context.Context, blocks chan<- struct{}) error
+}
+
+// notify signals a new block without blocking, one pending signal is enough to process all new blocks
+func notify(blocks chan<- struct{}) {
+	select {
+	case blocks <- struct{}{}:
+	default:
+	}
+}
+
+// zmqNotifier subscribes to the zmqpubhashblock or zmqpubrawblock notifications of bitcoind or litecoind
+type zmqNotifier struct {
+	endpoint string
+	// if set, the zmqpubrawtx notifications are subscribed as well
+	txs      chan<- []byte
+}
+
+func (n *zmqNotifier) Run(ctx context.Context, blocks chan<- struct{}) error {
+	// the timeout only limits waiting for a message, the connection is kept after it
+	topics := []string{"hashblock", "rawblock"}
+	if n.txs != nil {
+		topics = append(topics, "rawtx")
+	}
+	
+	conn, err := gozmq.Subscribe(n.endpoint, topics, time.Minute)
+	if err != nil {
+		return fmt.Errorf("subscribing to %s: %v", n.endpoint, err)
+	}
+	
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	
+	for {
+		msg, err := conn.Receive(nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// there was no block for a while or the connection was reestablished
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return err
+		}
+		
+		// a notification is the topic, the block or its hash and a sequence number
+		if len(msg) < 2 {
+			continue
+		}
+		
+		switch string(msg[0]) {
+		case "hashblock":
+			log.Debugf("zmq: new block %x\n", msg[1])
+			notify(blocks)
+		case "rawblock":
+			log.Debugf("zmq: new block (%d bytes)\n", len(msg[1]))
+			notify(blocks)
+		case "rawtx":
+			select {
+			case n.txs <- msg[1]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// wsNotifier subscribes to the block notifications of dcrd via its websocket
+type wsNotifier struct {
+	url  string
+	user string
+	pass string
+	// certificate of dcrd, nil without TLS
+	cert []byte
+}
+
+func (n *wsNotifier) Run(ctx context.Context, blocks chan<- struct{}) error {
+	dialer := websocket.Dialer{HandshakeTimeout: time.Minute}
+	if n.cert != nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(n.cert)
+		dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	
+	header := http.Header{}
+	header.Set("Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(n.user + ":" + n.pass)))
+	
+	conn, _, err := dialer.Dial(n.url, header)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", n.url, err)
+	}
+	
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	
+	if err := conn.WriteJSON(map[string]interface{}{"jsonrpc": "1.0", "id": 1, "method": "notifyblocks", "params": []interface{}{}}); err != nil {
+		return err
+	}
+	
+	for {
+		var msg struct {
+			Method string           `json:"method"`
+			Error  *btcjson.RPCError `json:"error"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		
+		if msg.Error != nil {
+			return fmt.Errorf("notifyblocks: %v", msg.Error)
+		}
+		
+		if msg.Method == "blockconnected" {
+			log.Debugf("websocket: new block\n")
+			notify(blocks)
+		}
+	}
+}
+
+// anchor starts following at the given height, the candidates of this block can not be retracted.
+// The caller must hold s.mu.
+func (s *scanner) anchor(ctx context.Context, height int64) error {
+	h, err := s.src.BlockHash(ctx, height)
+	if err != nil {
+		return err
+	}
+	
+	s.scan.Follow = []*followedBlock{{Height: height, Hash: h.String(), Offset: -1}}
+	
+	return writeCheckpoint(s.cpFileName, s.scan)
 }
 
-type candidate struct {
-	Block       int64    `json:"block"`
-	Timestamp   string   `json:"timestamp"`
-	Transaction string   `json:"transaction"`
-	InputTx     string   `json:"input_tx"`
-	InputValue  float64  `json:"input_value"`
-	Asm         []string `json:"asm"`
+// followTip retracts the candidates of orphaned blocks and processes all blocks up to the best block.
+// The caller must hold s.mu.
+func (s *scanner) followTip(ctx context.Context, depth int) error {
+	for {
+		bestHeight, err := s.src.BestHeight(ctx)
+		if err != nil {
+			return err
+		}
+		
+		// walk back until the last followed block is part of the best chain
+		for {
+			last := s.scan.Follow[len(s.scan.Follow) - 1]
+			if last.Height <= bestHeight {
+				h, err := s.src.BlockHash(ctx, last.Height)
+				if err != nil {
+					return err
+				}
+				if h.String() == last.Hash {
+					break
+				}
+			}
+			
+			log.Infof("block %d (%s) was orphaned\n", last.Height, last.Hash)
+			
+			// the outputs of the orphaned block do not exist (yet) on the best chain
+			if cache, ok := s.src.(*cachedSource); ok {
+				cache.forget(last.Hash)
+			}
+			
+			if last.Offset < 0 {
+				// the block was not followed, so its candidates are somewhere in the output
+				log.Infof("warning: the reorganisation is deeper than the followed blocks, the candidates of block %d stay in the output\n", last.Height)
+				if err := s.anchor(ctx, last.Height - 1); err != nil {
+					return err
+				}
+				break
+			}
+			
+			if err := s.retract(last.Offset); err != nil {
+				return err
+			}
+			s.scan.Follow = s.scan.Follow[:len(s.scan.Follow) - 1]
+			
+			if len(s.scan.Follow) == 0 {
+				if err := s.anchor(ctx, last.Height - 1); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		
+		last := s.scan.Follow[len(s.scan.Follow) - 1]
+		if last.Height >= bestHeight {
+			return nil
+		}
+		
+		// process the next block, a block which does not build on the last one was mined during a reorganisation
+		h, err := s.src.BlockHash(ctx, last.Height + 1)
+		if err != nil {
+			return err
+		}
+		block, err := s.src.Block(ctx, h)
+		if err != nil {
+			return err
+		}
+		if block.PreviousHash != last.Hash {
+			continue
+		}
+		
+		candidates, err := findHTLCs(ctx, s.src, block)
+		if err != nil {
+			return err
+		}
+		
+		if s.mempool != nil {
+			s.mempool.confirm(block)
+		}
+		
+		offset := s.scan.Offset
+		if err := s.write(candidates); err != nil {
+			return err
+		}
+		
+		log.Infof("followed block %d (%s), %d candidates\n", block.Height, block.Hash, len(candidates))
+		
+		s.scan.Follow = append(s.scan.Follow, &followedBlock{Height: block.Height, Hash: block.Hash, Offset: offset})
+		if len(s.scan.Follow) > depth {
+			s.scan.Follow = s.scan.Follow[len(s.scan.Follow) - depth:]
+			s.prune()
+		}
+		
+		if err := writeCheckpoint(s.cpFileName, s.scan); err != nil {
+			return err
+		}
+	}
 }
 
-func checkForTimeLock(scriptString string) (bool) {
+// encodeCandidates encodes candidates as one json object per line
+func encodeCandidates(candidates []*candidate) ([]byte, error) {
+	var buf bytes.Buffer
 	
-	script, err := hex.DecodeString(scriptString)
-	if err != nil {
-//		log.Fatalf("error decoding script. %v", err)
-		return false
+	for _, c := range candidates {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
 	}
 	
-	pops, err := txscript.ParseScript([]byte(script))
+	return buf.Bytes(), nil
+}
+
+// readCandidates reads a file with one candidate per line. It stops at the first line which is not complete,
+// e.g. because the scan was interrupted while writing it, and returns the size of the complete part.
+func readCandidates(fileName string) ([]*candidate, int64, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
 	if err != nil {
-//		log.Fatalf("error getting script. %v", err)
-		return false
+		return nil, 0, err
 	}
 	
-	if txscript.IsPubkey(pops) || txscript.IsPubkeyHash(pops) || txscript.IsMultiSig(pops) || txscript.IsNullData(pops) {
-		return false
-	}
+	var (
+		candidates []*candidate
+		size       int64
+	)
 	
-//	log.Infof("  new tx.")
+	for len(raw) > 0 {
+		end := bytes.IndexByte(raw, '\n')
+		if end < 0 {
+			break
+		}
+		
+		c := new(candidate)
+		if err := json.Unmarshal(raw[:end], c); err != nil {
+			break
+		}
+		
+		candidates = append(candidates, c)
+		size += int64(end + 1)
+		raw = raw[end + 1:]
+	}
 	
-	TLfound := false
-	HLfound := false
+	return candidates, size, nil
+}
+
+// blockStart returns where the candidates of the block at height start in the first size bytes of a part file.
+// The candidates of a block are written at once, so they are the last ones of the block the range stopped at.
+func blockStart(fileName string, size, height int64) (int64, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(raw)) > size {
+		raw = raw[:size]
+	}
 	
-	for _, pop := range pops {
-//		log.Infof("        OpValue: %s", pop.Opcode.Name)
-		if pop.Opcode.Value == txscript.OP_CHECKLOCKTIMEVERIFY || pop.Opcode.Value == txscript.OP_CHECKSEQUENCEVERIFY {
-			TLfound = true
+	var start int64
+	for len(raw) > 0 {
+		end := bytes.IndexByte(raw, '\n')
+		if end < 0 {
+			break
 		}
-		if pop.Opcode.Value == txscript.OP_RIPEMD160 || pop.Opcode.Value == txscript.OP_SHA1 || pop.Opcode.Value == txscript.OP_SHA256 || pop.Opcode.Value == txscript.OP_HASH160 || pop.Opcode.Value == txscript.OP_HASH256 {
-			HLfound = true
+		
+		c := new(candidate)
+		if err := json.Unmarshal(raw[:end], c); err == nil && c.Block == height {
+			return start, nil
 		}
 		
-		if TLfound && HLfound {
-			return true
+		start += int64(end + 1)
+		raw = raw[end + 1:]
+	}
+	
+	return size, nil
+}
+
+// openTruncated opens a file for appending after cutting it to size
+func openTruncated(fileName string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	
+	if info.Size() < size {
+		f.Close()
+		return nil, fmt.Errorf("%s is shorter than its checkpoint (%d < %d bytes)", fileName, info.Size(), size)
+	}
+	
+	if info.Size() > size {
+		log.Infof("removing %d bytes written after the last checkpoint from %s\n", info.Size() - size, fileName)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
 		}
 	}
 	
-	return false
+	return f, nil
+}
+
+// convertLegacyOutput converts the json array written by older versions into one candidate per line.
+// As these files were often left without the closing bracket, everything which can be parsed is kept.
+func convertLegacyOutput(fileName string) (bool, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || trimmed[0] != '[' {
+		return false, nil
+	}
+	
+	var candidates []*candidate
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.Token()
+	for dec.More() {
+		c := new(candidate)
+		if err := dec.Decode(c); err != nil {
+			break
+		}
+		candidates = append(candidates, c)
+	}
+	
+	converted, err := encodeCandidates(candidates)
+	if err != nil {
+		return false, err
+	}
+	
+	// keep the old file until the new one is complete
+	if err := ioutil.WriteFile(fileName + ".tmp", converted, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(fileName, fileName + ".legacy"); err != nil {
+		return false, err
+	}
+	if err := os.Rename(fileName + ".tmp", fileName); err != nil {
+		return false, err
+	}
+	
+	log.Infof("converted %d candidates of %s to one candidate per line, the old file is kept as %s.legacy\n", len(candidates), fileName, fileName)
+	
+	return true, nil
 }
 
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
-
+	
 	// parse command line flags
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		if err == flag.ErrHelp {
@@ -126,140 +5091,234 @@ func main() {
 		}
 		log.Fatalf("Error: %v", err)
 	}
-
+	
 	// set log level
 	if verbose {
-		log.SetLevel(log.LevelTrace)
-		jrpcLog.SetLevel(log.LevelTrace)
+		log.SetLevel(btclog.LevelTrace)
+		jrpcLog.SetLevel(btclog.LevelTrace)
 	} else {
-		log.SetLevel(log.LevelInfo)
-		jrpcLog.SetLevel(log.LevelInfo)
+		log.SetLevel(btclog.LevelInfo)
+		jrpcLog.SetLevel(btclog.LevelInfo)
 	}
 	
-	thisChain := ""
-	// set names for files depending on the specified chain
-	jsonFileName := "atomicswapsBTC.json"
-	blockFileName := "blockBTC.txt"
-	dcr := false
-	TLSstate := true
-	lowestBlock := int64(0)
-	
-	switch chain {
-	case "btc":
-		jsonFileName = "HTLCsBTC.json"
-		blockFileName = "blockBTC.txt"
-		thisChain = "bitcoin"
-		lowestBlock = 446033
-	case "BTC":
-		jsonFileName = "HTLCsBTC.json"
-		blockFileName = "blockBTC.txt"
-		thisChain = "bitcoin"
-		lowestBlock = 446033
-	case "ltc":
-		jsonFileName = "HTLCsLTC.json"
-		blockFileName = "blockLTC.txt"
-		thisChain = "litecoin"
-		lowestBlock = 1125292
-	case "LTC":
-		jsonFileName = "HTLCsLTC.json"
-		blockFileName = "blockLTC.txt"
-		thisChain = "litecoin"
-		lowestBlock = 1125292
-	case "bch":
-		jsonFileName = "HTLCsBCH.json"
-		blockFileName = "blockBCH.txt"
-		thisChain = "bitcoin"
-		lowestBlock = 478461
-	case "BCH":
-		jsonFileName = "HTLCsBCH.json"
-		blockFileName = "blockBCH.txt"
-		thisChain = "bitcoin"
-		lowestBlock = 478461
-	case "dcr":
-		jsonFileName = "HTLCsDCR.json"
-		blockFileName = "blockDCR.txt"
-		thisChain = "decred"
-		lowestBlock = 94501
-		dcr = true
-	case "DCR":
-		jsonFileName = "HTLCsDCR.json"
-		blockFileName = "blockDCR.txt"
-		thisChain = "decred"
-		lowestBlock = 94501
-		dcr = true
-	default:
-		log.Fatalf("error: wrong chain specified.")
+	chains, err := registry.Read(chainsFile)
+	if err != nil {
+		log.Fatalf("error reading the chain registry: %v", err)
 	}
-
-	// find params for chain
-	params, err := wire.GetParams(thisChain)
+	
+	c := registry.Find(chains, chain)
+	if c == nil {
+		log.Fatalf("error: chain %s is not in %s.", chain, chainsFile)
+	}
+	
+	allRules, err := readRules(rulesFile, c, chains)
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		log.Fatalf("error reading the detection rules: %v", err)
 	}
-
+	
+	if poolSpends, err = readPoolSpends(c); err != nil {
+		log.Fatalf("error reading %s: %v", chainsFile, err)
+	}
+	
+	enable := make(map[string]bool)
+	if enableFlag != "" {
+		for _, name := range strings.Split(enableFlag, ",") {
+			enable[strings.TrimSpace(name)] = true
+		}
+	}
+	for _, r := range allRules {
+		if !r.Disabled || enable[r.Name] {
+			rules = append(rules, r)
+		}
+		delete(enable, r.Name)
+	}
+	for name := range enable {
+		log.Fatalf("error: rule %s is not in %s.", name, rulesFile)
+	}
+	
+	// set names for files depending on the specified chain
+	jsonFileName := c.File("candidates")
+	blockFileName := c.File("block")
+	checkpointFileName := c.File("checkpoint")
+	lowestBlock := c.LowestBlock
+	dcr := c.RPC.API == "dcrd"
+	if c.Wire == "elements" {
+		leafVersion = elementsLeafVersion
+		feeOutputs = true
+	}
+	defaultPort := c.RPC.Port
+	
 	if port == "" {
-		port = params.DefaultRPCPort
+		port = defaultPort
+	}
+	
+	switch {
+	case rawFlag != "" && rawFlag != "rpc" && rawFlag != "rest":
+		log.Fatalf("error: -raw must be rpc or rest.")
+	case rawFlag != "" && c.Wire == "":
+		log.Infof("blocks of %s can not be decoded locally, requesting json", c.Name)
+	case c.RPC.GetBlock != "" && c.RPC.GetBlock != "verbosity" && c.RPC.GetBlock != "bool":
+		log.Fatalf("error: unknown getblock %q of %s in %s.", c.RPC.GetBlock, c.Name, chainsFile)
+	case rawFlag == "" && c.RPC.GetBlock == "bool" && c.Wire != "" && esploraURL == "" && dataDir == "":
+		// the json of the block only has the txids, fetching the transactions one by one needs -txindex
+		log.Infof("the node of %s can not return the transactions with the block, requesting serialized blocks", c.Name)
+		rawFlag = "rpc"
+	}
+	
+	// the block files of a stopped node get no new blocks and have no mempool
+	switch {
+	case dataDir != "" && mempoolFlag:
+		log.Fatalf("error: there is no mempool with -datadir.")
+	case dataDir != "" && followFlag:
+		log.Fatalf("error: -follow needs a running node, the block files of -datadir do not change.")
 	}
 	
-	cert := []byte{}
+	var (
+		src  blockSource
+		cert []byte
+	)
 	
-	if dcr {
-		TLSstate = false
+	switch {
+	case esploraURL != "":
+		src = newEsploraSource(esploraURL, concurrency, retries)
+	case dataDir != "":
+		// the block files are only readable for chains with the serialization of bitcoin core
+		if c.Wire != "bitcoin" {
+			log.Fatalf("error: reading block files is not supported for %s.", c.Name)
+		}
 		
-		cert, err = ioutil.ReadFile("rpc.cert")
+		// read the blocks from the files of the node
+		src, err = newFileSource(dataDir)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("error opening block files: %v", err)
+		}
+	default:
+		if certFile == "" {
+			certFile = c.RPC.Cert
+		}
+		if c.RPC.TLS && certFile != "" {
+			cert, err = ioutil.ReadFile(certFile)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
+		
+		// create new RPC client instance
+		src, err = newRPCSource(&rpcclient.ConnConfig{
+			HTTPPostMode: true,
+			DisableTLS:   !c.RPC.TLS,
+			Certificates: cert,
+			Host:         net.JoinHostPort(host, port),
+			User:         user,
+			Pass:         pass,
+		}, dcr, concurrency, retries, rawFlag, c.Wire, c.RPC.GetBlock == "bool")
+		if err != nil {
+			log.Fatalf("error creating rpc client: %v", err)
+		}
+		
+		src = newCachedSource(src, cacheSize, depthFlag)
 	}
 	
-	// create new RPC client instance for other currencies
-	c, err := rpc.New(&rpc.ConnConfig{
-		Threads:      concurrency,
-		DisableTLS:   TLSstate,
-		Certificates: cert,
-		Host:         net.JoinHostPort(host, port),
-		User:         user,
-		Pass:         pass,
-	}, params)
-	if err != nil {
-		log.Fatalf("error creating rpc client: %v", err)
-	}
-
 	// create a new context for RPC calls
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	
-	// read file with current block
-	content, err := ioutil.ReadFile(blockFileName)
-    if err != nil {
-        log.Fatal(err)
-    }
+	bestHeight, err := src.BestHeight(ctx)
+	if err != nil {
+		log.Fatalf("error getting info: %v", err)
+	} else {
+		log.Infof("best block height: %d\n", bestHeight)
+	}
 	
-	// get the height from the file content
-	heightString, err := strconv.Atoi(string(content))
+	// read the progress of the last scan
+	cp, err := readCheckpoint(checkpointFileName)
 	if err != nil {
-        log.Fatal(err)
-    }
+		log.Fatal(err)
+	}
+	if cp == nil {
+		if cp, err = readLegacyCheckpoint(blockFileName, lowestBlock); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// checkpoints of older versions may start in the history shared with the parent chain
+	if cp != nil && c.Fork != nil {
+		cp.startAt(c.Fork.Height)
+	}
 	
-	if dcr {
-		height = int64(heightString)
-	} else {
-		info, err := c.GetBlockChainInfo(ctx)
-		if err != nil {
-			log.Fatalf("error getting info: %v", err)
-		} else {
-			b, _ := json.MarshalIndent(info, "", "  ")
-			log.Infof("%s\n", string(b))
+	// if no range is specified, the range of the last scan is continued
+	rangeSet := false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "from", "to", "forward", "height":
+			rangeSet = true
+		}
+	})
+	
+	// by default scan from the first block which may contain HTLCs up to the best block
+	scan := checkpoint{
+		From: lowestBlock,
+		To: bestHeight,
+		Forward: forward,
+	}
+	
+	if rangeSet || cp == nil {
+		if err := resolveRange(ctx, src, fromFlag, toFlag, bestHeight, &scan); err != nil {
+			log.Fatal(err)
 		}
+		if height > 0 {
+			if forward {
+				scan.From = height
+			} else {
+				scan.To = height
+			}
+		}
+	} else {
+		scan.From = cp.From
+		scan.To = cp.To
+		scan.Forward = cp.Forward
+	}
+	
+	if scan.To > bestHeight {
+		log.Infof("warning: block %d is not known yet, scanning up to %d\n", scan.To, bestHeight)
+		scan.To = bestHeight
+	}
+	// the history shared with the parent chain is scanned there
+	if c.Fork != nil && scan.From < c.Fork.Height {
+		log.Infof("blocks below %d belong to %s, scanning from %d\n", c.Fork.Height, c.Fork.Parent, c.Fork.Height)
+		scan.From = c.Fork.Height
+	}
+	if scan.From < 0 || scan.From > scan.To {
+		log.Fatalf("error: invalid block range %d to %d", scan.From, scan.To)
+	}
+	
+	// continue the parts of the last scan if it had the same range
+	sameRange := cp != nil && cp.From == scan.From && cp.To == scan.To && cp.Forward == scan.Forward
+	switch {
+	case sameRange && len(cp.Ranges) > 0:
+		scan = *cp
+	case sameRange && cp.Hash != "":
+		// the last scan is finished or was not split into parts
+		scan.Height = cp.Height
+		scan.Hash = cp.Hash
 		
-		// if the content of the blockfile is lower than 10000, get the current highest block number
-		if heightString < 10000 {
-			height = int64(info.Blocks)
+		remaining := &scanRange{From: scan.From, To: scan.To, Height: cp.Height, Hash: cp.Hash}
+		if scan.Forward {
+			remaining.From = cp.Height
 		} else {
-			height = int64(heightString)
+			remaining.To = cp.Height
 		}
+		scan.Ranges = []*scanRange{remaining}
+	default:
+		scan.Ranges = splitRange(scan.From, scan.To, scan.Forward, chunkSize)
+	}
+	
+	// the followed blocks are on top of the range
+	if sameRange {
+		scan.Follow = cp.Follow
 	}
 	
+	log.Infof("scanning blocks %d to %d (forward=%v) in %d parts\n", scan.From, scan.To, scan.Forward, len(scan.Ranges))
+	
 //	// read candidate struct from json file
 //	raw, err := ioutil.ReadFile(jsonFileName)
 //	if err != nil {
@@ -272,148 +5331,102 @@ func main() {
 //	if err != nil {
 //		log.Fatal(err)
 //	}
-		
-	// get block hash from height
-	h, err := c.GetBlockHash(ctx, height)
+	
+	// older versions wrote a json array
+	converted, err := convertLegacyOutput(jsonFileName)
 	if err != nil {
-		log.Fatalf("error getting block hash for height %d: %v", height, err)
+		log.Fatal(err)
 	}
 	
-	// try fetching a block to let the RPC package detect which verbosity mode
-	// to use (we ignore the return value and any error here)
-	c.GetBlockVerbose(ctx, h)
-	
-	var (
-		ntx   int
-	)
+	// anything behind the offset of the checkpoint was written after it and will be written again.
+	// Without a checkpoint offset only an incomplete last line is removed.
+	var offset int64
+	if !converted && cp != nil && cp.Offset > 0 {
+		offset = cp.Offset
+	} else if _, offset, err = readCandidates(jsonFileName); err != nil {
+		log.Fatal(err)
+	}
+	scan.Offset = offset
 	
-	w, err := os.OpenFile(jsonFileName, os.O_CREATE|os.O_RDWR, 0666)
+	w, err := openTruncated(jsonFileName, offset)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer w.Close()
-	defer io.WriteString(w, "\n]")
 	
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	//io.WriteString(w, "[")
-	_, err = w.Seek(-2, os.SEEK_END)
+	// remember the candidates in the output which may be found again to not write them twice
+	outCandidates, _, err := readCandidates(jsonFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	seen := make(map[string]int64)
 	
-	// process all available blocks
-	for ; height >= lowestBlock; height-- {
-		// get a block with all transactions
-		block, err := c.GetBlockVerbose(ctx, h)
-		if err != nil {
-			log.Fatalf("error fetching block: %v", err)
-		}
-		if block.Height != height {
-			log.Infof("warning: block height mismatch exp=%d got=%d\n", height, block.Height)
-		}
-		// change block.PreviousHash to block.NextHash, when changing search direction
-		if h, err = hash.NewHashFromStr(block.PreviousHash); err != nil {
-			log.Infof("error getting next block hash from %s: %v", block.PreviousHash, err)
+	if err := writeCheckpoint(checkpointFileName, &scan); err != nil {
+		log.Fatal(err)
+	}
+	
+	s := &scanner{
+		src: src,
+		scan: &scan,
+		cpFileName: checkpointFileName,
+		partDir: jsonFileName + ".parts",
+		out: w,
+		seen: seen,
+		wire: c.Wire,
+	}
+	for _, c := range outCandidates {
+		if s.replayable(c.Block) {
+			seen[inputKey(c.Transaction, c.InputIndex)] = c.Block
 		}
-
-		// skip genesis block transactions
-		if height == 0 {
-			continue
+	}
+	
+	// process all blocks of the range
+	if err := s.run(ctx, workers); err != nil {
+		log.Fatal(err)
+	}
+	
+	if followFlag {
+		var txs chan []byte
+		if mempoolFlag {
+			s.mempool = newMempool(c.File("mempool"))
+			
+			// announced transactions of chains with an unknown serialization are left to the poll of the mempool
+			if zmqFlag != "" && c.Wire != "" {
+				txs = make(chan []byte, 100)
+			}
 		}
-
-		// get transactions from id
-		if block.Tx == nil {
-			txHashes := make([]*hash.Hash, len(block.TxIds))
-			for i, v := range block.TxIds {
-				txHashes[i], _ = hash.NewHashFromStr(v)
+		
+		var notifier blockNotifier
+		switch {
+		case zmqFlag != "":
+			notifier = &zmqNotifier{endpoint: zmqFlag, txs: txs}
+		case wsFlag:
+			scheme := "wss"
+			if !c.RPC.TLS {
+				scheme = "ws"
 			}
-			// fetch all tx in parallel
-			block.Tx, err = c.GetRawTransactionsVerbose(ctx, txHashes)
-			if err != nil {
-				log.Fatalf("error getting txs in block %d: %v", block.Height, err)
+			notifier = &wsNotifier{
+				url: scheme + "://" + net.JoinHostPort(host, port) + "/ws",
+				user: user,
+				pass: pass,
+				cert: cert,
 			}
 		}
-		ntx += len(block.Tx)
-
-		// walk all transactions
-		for _, tx := range block.Tx {
-			
-			// check inputs
-			// walk all tx inputs
-			for _, in := range tx.Vin {
-				
-				if in.IsCoinBase() {
-					continue
-				}
-				
-				// decode to string
-				scriptString, err := hex.DecodeString(in.ScriptSig.Hex)
-				
-				if err != nil {
-					log.Fatalf("error decoding script string from tx: %v", err)
-				}
-				
-				// decode string as script
-				script, err := c.DecodeScript(ctx, []byte(scriptString))
-				
-				if err != nil {
-					log.Fatalf("error getting script. %v", err)
-				}
-				
-				// decompose the asm of the script (the datapushes)
-				asmStrings := strings.Split(script.Asm, " ")
-				
-				length := len(asmStrings)
-				
-				if checkForTimeLock(asmStrings[length - 1]) {
-					log.Infof("      Found timelock in Tx: %s", tx.Txid)
-					
-					inputTx := in.Txid
-					
-					prevTxHash, err := hash.NewHashFromStr(inputTx)
-					if err != nil {
-						log.Fatal(err)
-					}
-					
-					prevTx, err := c.GetRawTransactionVerbose(ctx, prevTxHash)
-					if err != nil {
-						log.Fatal(err)
-					}
-					
-					prevOutInd := in.Vout
-					prevOut := prevTx.Vout[prevOutInd]
-					inputValue := prevOut.Value
-					
-					thisCandidate := new(candidate)
-					
-					*thisCandidate = candidate {
-						Block: block.Height,
-						Timestamp: time.Unix(block.Time, 0).UTC().String(),
-						Transaction: tx.Txid,
-						InputTx: inputTx,
-						InputValue: inputValue,
-						Asm: asmStrings,
-					}
-					
-					io.WriteString(w, ",\n\t")
-					
-					enc.Encode(thisCandidate)
-					
-					_, err = w.Seek(-1, os.SEEK_END)
-					
+		
+		// without notifications new blocks are only found by polling
+		var blocks chan struct{}
+		if notifier != nil {
+			blocks = make(chan struct{}, 1)
+			go func() {
+				if err := notifier.Run(ctx, blocks); err != nil && ctx.Err() == nil {
+					log.Fatalf("error receiving block notifications: %v", err)
 				}
-			}
+			}()
 		}
-
-		log.Infof("Block %6d: %s (%d)\tsize=%d\tn_tx=%d\n",
-			height,
-			time.Unix(block.Time, 0).UTC().String(),
-			block.Time,
-			block.Size,
-			len(block.TxIds),
-		)
 		
-		err = ioutil.WriteFile(blockFileName, []byte(strconv.FormatInt(height, 10)), 0644)
-		if err != nil {
+		log.Infof("following the tip of the chain\n")
+		if err := s.follow(ctx, blocks, txs, pollFlag, depthFlag); err != nil {
 			log.Fatal(err)
 		}
 	}
-}
\ No newline at end of file
+}
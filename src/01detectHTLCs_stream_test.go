@@ -0,0 +1,2893 @@
+// Author: dominik.lauck@mailbox.tu-dresden.de
+// 
+// The scripts in this directory are separate programs, so the tests of the detection are run with
+// go test 01detectHTLCs_stream.go 01detectHTLCs_stream_test.go
+// The blocks in testdata are serialized in the formats of the chains with the values given in the tests.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	
+	"detect-atomic-swaps/registry"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// readFixture reads a hex dump from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	b, err := hex.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	
+	return b
+}
+
+// useRules sets the enabled rules of rules.json, the pool spends and the rules of the serialization for the detection
+// on a chain of chains.json
+func useRules(t *testing.T, chain string) *registry.Chain {
+	t.Helper()
+	
+	chains, err := registry.Read("chains.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := registry.Find(chains, chain)
+	if c == nil {
+		t.Fatalf("chain %s is not in chains.json", chain)
+	}
+	
+	allRules, err := readRules("rules.json", c, chains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	rules = nil
+	for _, r := range allRules {
+		if !r.Disabled {
+			rules = append(rules, r)
+		}
+	}
+	
+	if poolSpends, err = readPoolSpends(c); err != nil {
+		t.Fatal(err)
+	}
+	
+	leafVersion = txscript.BaseLeafVersion
+	feeOutputs = c.Wire == "elements"
+	if feeOutputs {
+		leafVersion = elementsLeafVersion
+	}
+	
+	return c
+}
+
+// testSource is a blockSource serving blocks and outputs from memory
+type testSource struct {
+	// blocks may be added while a scanner reads them
+	mu     sync.Mutex
+	blocks []*block
+	outs   map[string]*txOut
+	// the transactions in the mempool
+	unconfirmed []*transaction
+}
+
+// add appends a block at the tip
+func (s *testSource) add(b *block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	s.blocks = append(s.blocks, b)
+}
+
+func (s *testSource) BestHeight(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	return int64(len(s.blocks) - 1), nil
+}
+
+func (s *testSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if height < 0 || height >= int64(len(s.blocks)) {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	
+	return chainhash.NewHashFromStr(s.blocks[height].Hash)
+}
+
+func (s *testSource) BlockHeader(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	b, err := s.Block(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &block{Hash: b.Hash, Height: b.Height, Time: b.Time, PreviousHash: b.PreviousHash, NextHash: b.NextHash}, nil
+}
+
+func (s *testSource) Block(ctx context.Context, h *chainhash.Hash) (*block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	for _, b := range s.blocks {
+		if b.Hash == h.String() {
+			return b, nil
+		}
+	}
+	
+	return nil, fmt.Errorf("unknown block %s", h)
+}
+
+func (s *testSource) Transaction(ctx context.Context, txid *chainhash.Hash) (*transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	for _, b := range s.blocks {
+		for _, tx := range b.Tx {
+			if tx.Txid == txid.String() {
+				return tx, nil
+			}
+		}
+	}
+	for _, tx := range s.unconfirmed {
+		if tx.Txid == txid.String() {
+			return tx, nil
+		}
+	}
+	
+	return nil, fmt.Errorf("unknown transaction %s", txid)
+}
+
+func (s *testSource) PrevOut(ctx context.Context, in *txIn) (*txOut, error) {
+	if in.PrevOut != nil {
+		return in.PrevOut, nil
+	}
+	if out, ok := s.outs[outPointKey(in.Txid, in.Vout)]; ok {
+		return out, nil
+	}
+	
+	return nil, fmt.Errorf("unknown output %s:%d", in.Txid, in.Vout)
+}
+
+func (s *testSource) Mempool(ctx context.Context) ([]*chainhash.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	var txids []*chainhash.Hash
+	for _, tx := range s.unconfirmed {
+		txid, err := chainhash.NewHashFromStr(tx.Txid)
+		if err != nil {
+			return nil, err
+		}
+		txids = append(txids, txid)
+	}
+	
+	return txids, nil
+}
+
+// newTestChain returns a testSource with a chain of empty blocks with the given timestamps
+func newTestChain(times ...int64) *testSource {
+	s := new(testSource)
+	for h, t := range times {
+		b := &block{Hash: fmt.Sprintf("%064x", h + 1), Height: int64(h), Time: t}
+		if h > 0 {
+			b.PreviousHash = s.blocks[h - 1].Hash
+			s.blocks[h - 1].NextHash = b.Hash
+		}
+		s.add(b)
+	}
+	
+	return s
+}
+
+// zcashTxWant are the fields of a decoded zcash transaction checked by the tests
+type zcashTxWant struct {
+	txid                string
+	version             int32
+	size                int64
+	lockTime            uint32
+	expiry              uint32
+	vin                 int
+	vout                []int64
+	valueBalanceSapling int64
+	valueBalanceOrchard int64
+	vpubOld             int64
+	vpubNew             int64
+}
+
+func checkZcashBlock(t *testing.T, b *block, want []zcashTxWant) {
+	t.Helper()
+	
+	if len(b.Tx) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(b.Tx), len(want))
+	}
+	
+	for i, w := range want {
+		tx := b.Tx[i]
+		if tx.Txid != w.txid {
+			t.Errorf("tx %d: txid %s, want %s", i, tx.Txid, w.txid)
+		}
+		if tx.Version != w.version || tx.VSize != w.size || tx.LockTime != w.lockTime || tx.Expiry != w.expiry {
+			t.Errorf("tx %d: version %d size %d locktime %d expiry %d, want %d %d %d %d", i,
+				tx.Version, tx.VSize, tx.LockTime, tx.Expiry, w.version, w.size, w.lockTime, w.expiry)
+		}
+		if len(tx.Vin) != w.vin || len(tx.Vout) != len(w.vout) {
+			t.Fatalf("tx %d: %d inputs and %d outputs, want %d and %d", i, len(tx.Vin), len(tx.Vout), w.vin, len(w.vout))
+		}
+		for j, value := range w.vout {
+			if tx.Vout[j].Value != value {
+				t.Errorf("tx %d: output %d has value %d, want %d", i, j, tx.Vout[j].Value, value)
+			}
+		}
+		if tx.ValueBalanceSapling != w.valueBalanceSapling || tx.ValueBalanceOrchard != w.valueBalanceOrchard {
+			t.Errorf("tx %d: value balances %d %d, want %d %d", i,
+				tx.ValueBalanceSapling, tx.ValueBalanceOrchard, w.valueBalanceSapling, w.valueBalanceOrchard)
+		}
+		if tx.VPubOld != w.vpubOld || tx.VPubNew != w.vpubNew {
+			t.Errorf("tx %d: vpub_old %d vpub_new %d, want %d %d", i, tx.VPubOld, tx.VPubNew, w.vpubOld, w.vpubNew)
+		}
+	}
+}
+
+// checkZcashClaim checks that the claim of the HTLC in the second transaction is found with its fee
+func checkZcashClaim(t *testing.T, b *block, prevValue int64, fee float64) {
+	t.Helper()
+	
+	useRules(t, "ZEC")
+	
+	tx := b.Tx[1]
+	tx.Vin[0].PrevOut = &txOut{Value: prevValue}
+	candidates, err := findTxHTLCs(context.Background(), &testSource{}, b, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("got %d candidates, want 1", len(candidates))
+	}
+	
+	c := candidates[0]
+	if c.SpendType != "p2sh" || c.InputTx != strings.Repeat("11", 32) || c.Expiry != tx.Expiry {
+		t.Errorf("got candidate %+v", c)
+	}
+	if c.Fee == nil || *c.Fee != fee {
+		t.Errorf("got fee %v, want %v", c.Fee, fee)
+	}
+}
+
+func TestDecodeZcashV4Block(t *testing.T) {
+	b, err := decodeBlock("zcash", readFixture(t, "zcash_v4.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if b.Time != 1570000000 || b.PreviousHash != strings.Repeat("0", 62) + "07" {
+		t.Errorf("got time %d and previous block %s", b.Time, b.PreviousHash)
+	}
+	
+	checkZcashBlock(t, b, []zcashTxWant{
+		{
+			txid: "f08476ac8498560db730ba88a62c131095198b5d021df06977e2f8f2347bf1f7",
+			version: 4, size: 109, expiry: 600020, vin: 1, vout: []int64{625000000},
+		},
+		{
+			// shields 50000 with a sapling output, a joinsplit takes 10000 and returns 5000
+			txid: "6281826963a40360d6b364b195ca56dc8d930d069f5369de79d07b3b10149db4",
+			version: 4, size: 3132, lockTime: 599990, expiry: 600040, vin: 1, vout: []int64{20000},
+			valueBalanceSapling: -50000, vpubOld: 10000, vpubNew: 5000,
+		},
+		{
+			txid: "cc95221f437bbb3574fe819c7f2aa85ec6128c75b6b0d55a103feda58200c1ef",
+			version: 4, size: 245, expiry: 600050, vin: 1, vout: []int64{70000, 9000},
+		},
+	})
+	
+	if !b.Tx[0].Vin[0].Coinbase || b.Tx[1].Vin[0].Coinbase {
+		t.Error("coinbase not recognised")
+	}
+	
+	// 100000 - 20000 - 50000 - 10000 + 5000
+	checkZcashClaim(t, b, 100000, 0.00025)
+}
+
+func TestDecodeZcashV5Block(t *testing.T) {
+	b, err := decodeBlock("zcash", readFixture(t, "zcash_v5.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// the txids of v5 transactions are taken from the node, the v4 transaction after them shows
+	// that the v5 transactions were read to their end
+	checkZcashBlock(t, b, []zcashTxWant{
+		{
+			version: 5, size: 105, expiry: 1700020, vin: 1, vout: []int64{312500000},
+		},
+		{
+			// a sapling spend and output unshield 30000, an orchard action shields 40000
+			version: 5, size: 3018, lockTime: 1699990, expiry: 1700040, vin: 1, vout: []int64{60000},
+			valueBalanceSapling: 30000, valueBalanceOrchard: -40000,
+		},
+		{
+			txid: "6c7815ebb31038d9c058e3f866a6882e1c098e064d67fc0fa30d79752296fe42",
+			version: 4, size: 211, expiry: 1700050, vin: 1, vout: []int64{80000},
+		},
+	})
+	
+	// 100000 - 60000 + 30000 - 40000
+	checkZcashClaim(t, b, 100000, 0.0003)
+}
+
+// openBlocksDir opens testdata/blocks, a blocks directory of regtest in the format of Bitcoin Core 28 (obfuscated
+// with xor.dat) with the blocks 1 to 3 connected and a branch from block 1 with more work, of which the blocks 2 to 4 were
+// stored but never connected and block 5 is only a header. Opening the index writes to its directory, so it is copied.
+func openBlocksDir(t *testing.T) *fileSource {
+	t.Helper()
+	
+	dataDir := t.TempDir()
+	err := filepath.Walk(filepath.Join("testdata", "blocks"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		
+		target := filepath.Join(dataDir, strings.TrimPrefix(path, "testdata"))
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, raw, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	src, err := newFileSource(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	return src
+}
+
+func TestDecodeLiquidBlock(t *testing.T) {
+	// a block with dynamic federation parameters in the serialization of elements: the coinbase, the claim of
+	// an HTLC with blinded outputs, an issuance of an asset with explicit outputs and a peg-in
+	b, err := decodeBlock("elements", readFixture(t, "liquid_block.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if b.Height != 3003840 || b.Time != 1720000000 || b.PreviousHash != strings.Repeat("0c", 32) {
+		t.Errorf("got height %d, time %d and previous block %s", b.Height, b.Time, b.PreviousHash)
+	}
+	
+	const (
+		lbtc  = "6f0279e9ed041c3d710a9f57d0c02928416460c4b722ae3457a11eec381c526d"
+		asset = "d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1d1"
+		token = "e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2e2"
+	)
+	type outWant struct {
+		asset   string
+		value   int64
+		blinded bool
+	}
+	tests := []struct {
+		txid     string
+		size     int64
+		coinbase bool
+		vout     uint32
+		outs     []outWant
+		// the sum of the fee outputs
+		fee      int64
+	}{
+		{
+			txid: "8c0d0099d056391d2e5942a0e07fce16ca3eb23bf058f7ec61076d94ea183d59", size: 194, coinbase: true, vout: 0xffffffff,
+			outs: []outWant{{lbtc, 398, false}, {lbtc, 0, false}},
+		},
+		{
+			txid: "b032c4803c9d670d61e2c72a235e2ecc6b65a3d83306997bb420b14a7928f6ca", size: 552,
+			outs: []outWant{{"", 0, true}, {"", 0, true}, {lbtc, 48, false}}, fee: 48,
+		},
+		{
+			// the input has the issuance flag, the index is 1
+			txid: "1c90ba51c13149eb7b59f83eac2e8089274e862f1c1c80c288c3b65070aa74a1", size: 406, vout: 1,
+			outs: []outWant{{asset, 1000000, false}, {token, 1, false}, {lbtc, 99700, false}, {lbtc, 300, false}}, fee: 300,
+		},
+		{
+			// the peg-in spends an output of the main chain
+			txid: "050a1ff824dd333196c98636852e1fc24a38d2c97e8ca4c58c449a520cf36fc5", size: 282, coinbase: true,
+			outs: []outWant{{lbtc, 49950, false}, {lbtc, 50, false}}, fee: 50,
+		},
+	}
+	
+	if len(b.Tx) != len(tests) {
+		t.Fatalf("got %d transactions, want %d", len(b.Tx), len(tests))
+	}
+	// the fee is stated in outputs on elements chains
+	useRules(t, "LBTC")
+	
+	for i, test := range tests {
+		tx := b.Tx[i]
+		if tx.Txid != test.txid || tx.VSize != test.size {
+			t.Errorf("tx %d: txid %s size %d, want %s %d", i, tx.Txid, tx.VSize, test.txid, test.size)
+		}
+		if len(tx.Vin) != 1 || tx.Vin[0].Coinbase != test.coinbase || tx.Vin[0].Vout != test.vout {
+			t.Fatalf("tx %d: got inputs %+v", i, tx.Vin)
+		}
+		if len(tx.Vout) != len(test.outs) {
+			t.Fatalf("tx %d: %d outputs, want %d", i, len(tx.Vout), len(test.outs))
+		}
+		for j, want := range test.outs {
+			if out := tx.Vout[j]; out.Asset != want.asset || out.Value != want.value || out.Blinded != want.blinded {
+				t.Errorf("tx %d: output %d has asset %q value %d blinded %v, want %q %d %v", i, j,
+					out.Asset, out.Value, out.Blinded, want.asset, want.value, want.blinded)
+			}
+		}
+		if i == 0 {
+			continue
+		}
+		if fee, ok := transactionFee(&testSource{}, tx); !ok || fee != test.fee {
+			t.Errorf("tx %d: fee %d, want %d", i, fee, test.fee)
+		}
+	}
+	
+	// the claim of the HTLC is found with the witness of its input and the fee of its fee output
+	tx := b.Tx[1]
+	if w := tx.Vin[0].Witness; len(w) != 4 || !bytes.Equal(w[3], scriptOf(t, htlcScript)) {
+		t.Fatalf("got witness %x", w)
+	}
+	tx.Vin[0].PrevOut = &txOut{Asset: lbtc, Value: 100000}
+	candidates, err := findTxHTLCs(context.Background(), &testSource{}, b, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].SpendType != "p2wsh" || candidates[0].Fee == nil || *candidates[0].Fee != 0.00000048 {
+		t.Errorf("got candidates %+v", candidates)
+	}
+}
+
+func TestDecodeTx(t *testing.T) {
+	_, notes := readZMQFixture(t)
+	
+	announced, err := hex.DecodeString(notes[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4 := readFixture(t, "zcash_v4.hex")
+	v5 := readFixture(t, "zcash_v5.hex")
+	
+	tests := []struct {
+		format  string
+		raw     []byte
+		txid    string
+		size    int64
+		invalid bool
+	}{
+		{format: "bitcoin", raw: announced, txid: "00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e", size: 138},
+		{format: "auxpow", raw: announced, txid: "00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e", size: 138},
+		// the last transactions of the blocks of TestDecodeZcashV4Block and TestDecodeZcashV5Block
+		{format: "zcash", raw: v4[len(v4) - 245:], txid: "cc95221f437bbb3574fe819c7f2aa85ec6128c75b6b0d55a103feda58200c1ef", size: 245},
+		{format: "zcash", raw: v5[len(v5) - 211 - 3018:len(v5) - 211], size: 3018},
+		// e.g. the MWEB data of a litecoin transaction
+		{format: "bitcoin", raw: append(append([]byte{}, announced...), 0), invalid: true},
+		{format: "bitcoin", raw: announced[:100], invalid: true},
+		{format: "zcash", raw: v4[len(v4) - 246:], invalid: true},
+		{format: "", raw: announced, invalid: true},
+	}
+	
+	for i, test := range tests {
+		tx, err := decodeTx(test.format, test.raw)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%d: invalid %s transaction decoded", i, test.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if tx.Txid != test.txid || tx.VSize != test.size {
+			t.Errorf("%d: got txid %s and size %d, want %s and %d", i, tx.Txid, tx.VSize, test.txid, test.size)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	src := openBlocksDir(t)
+	ctx := context.Background()
+	
+	// the branch with more work is not connected
+	if height, _ := src.BestHeight(ctx); height != 3 {
+		t.Fatalf("got best height %d, want 3", height)
+	}
+	
+	want := []string{
+		"0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+		"5b8b29420049ce3d25a25b2aea0f41efb802330c3a17416eef5bf0829534c1e6",
+		"7a66b2f63d1c7be6af270d1164116559cf7c467515ea72d1adc5735fdd842e31",
+		"364101aa1cc447e3b5877ae417deecd9d8c9c8b80d14eb5ad47b1b538cb05464",
+	}
+	var blocks []*block
+	for height, hash := range want {
+		h, err := src.BlockHash(ctx, int64(height))
+		if err != nil || h.String() != hash {
+			t.Fatalf("got block hash %v at %d: %v", h, height, err)
+		}
+		
+		b, err := src.Block(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Height != int64(height) || (height > 0 && b.PreviousHash != want[height - 1]) {
+			t.Errorf("got block %d after %s", b.Height, b.PreviousHash)
+		}
+		blocks = append(blocks, b)
+	}
+	
+	header, err := src.BlockHeader(ctx, mustHash(t, want[2]))
+	if err != nil || header.Height != 2 || header.NextHash != want[3] || header.Time != blocks[2].Time {
+		t.Errorf("got header %+v: %v", header, err)
+	}
+	
+	// the undo data holds the spent outputs: the coinbase of block 1, then the P2SH, the compressed and the
+	// uncompressed P2PK and the P2WSH output of block 2
+	if len(blocks[2].Tx) != 2 || len(blocks[3].Tx) != 2 || len(blocks[3].Tx[1].Vin) != len(blocks[2].Tx[1].Vout) {
+		t.Fatalf("got blocks with %d and %d transactions", len(blocks[2].Tx), len(blocks[3].Tx))
+	}
+	spends := map[*txIn]*txOut{blocks[2].Tx[1].Vin[0]: blocks[1].Tx[0].Vout[0]}
+	for vout, out := range blocks[2].Tx[1].Vout {
+		spends[blocks[3].Tx[1].Vin[vout]] = out
+	}
+	
+	var sum int64
+	for in, out := range spends {
+		got := in.PrevOut
+		if got == nil || got.Value != out.Value || !bytes.Equal(got.PkScript, out.PkScript) {
+			t.Errorf("input %s:%d: got spent output %+v, want %+v", in.Txid, in.Vout, got, out)
+			continue
+		}
+		sum += got.Value
+	}
+	if sum != 5000000000 + 4999990000 {
+		t.Errorf("got spent outputs of %d", sum)
+	}
+	
+	// the last block of the branch is only known by its header
+	side := mustHash(t, "3dd3201832fde50f83c0b725d967320bd098709c6e3437d9d4985fbabc2a3b99")
+	if _, err := src.Block(ctx, side); err == nil {
+		t.Errorf("got the header only block of the branch")
+	}
+}
+
+func mustHash(t *testing.T, s string) *chainhash.Hash {
+	t.Helper()
+	
+	h, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestReadCoreVarInt(t *testing.T) {
+	// serialize_tests.cpp of Bitcoin Core
+	tests := []struct {
+		raw  string
+		want uint64
+	}{
+		{"00", 0},
+		{"7f", 0x7f},
+		{"8000", 0x80},
+		{"a334", 0x1234},
+		{"82fe7f", 0xffff},
+		{"c7e756", 0x123456},
+		{"86ffc7e756", 0x80123456},
+		{"8efefefe7f", 0xffffffff},
+		{"fefefefefefefefe7f", 0x7fffffffffffffff},
+		{"80fefefefefefefefe7f", 0xffffffffffffffff},
+	}
+	
+	for _, test := range tests {
+		raw, _ := hex.DecodeString(test.raw)
+		r := bytes.NewReader(raw)
+		if got, err := readCoreVarInt(r); err != nil || got != test.want || r.Len() != 0 {
+			t.Errorf("%s: got %x: %v", test.raw, got, err)
+		}
+	}
+	
+	if _, err := readCoreVarInt(bytes.NewReader([]byte{0x80})); err == nil {
+		t.Errorf("truncated number is accepted")
+	}
+}
+
+func TestDecompressAmount(t *testing.T) {
+	// compressor_tests.cpp of Bitcoin Core
+	tests := []struct {
+		compressed uint64
+		want       uint64
+	}{
+		{0, 0},
+		{1, 1},
+		{0x7, 1000000},
+		{0x9, 100000000},
+		{0x32, 50 * 100000000},
+		{0x1406f40, 21000000 * 100000000},
+	}
+	
+	for _, test := range tests {
+		if got := decompressAmount(test.compressed); got != test.want {
+			t.Errorf("%x: got %d, want %d", test.compressed, got, test.want)
+		}
+	}
+}
+
+func TestReadCompressedScript(t *testing.T) {
+	hash := strings.Repeat("11", 20)
+	x := strings.Repeat("22", 32)
+	// the key of the output of the genesis block
+	genesisKey := "04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f"
+	p2wsh := "0020" + strings.Repeat("33", 32)
+	
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"p2pkh", "00" + hash, "76a914" + hash + "88ac"},
+		{"p2sh", "01" + hash, "a914" + hash + "87"},
+		{"p2pk even", "02" + x, "2102" + x + "ac"},
+		{"p2pk odd", "03" + x, "2103" + x + "ac"},
+		{"p2pk uncompressed", "05" + genesisKey[2:66], "41" + genesisKey + "ac"},
+		{"other", "28" + p2wsh, p2wsh},
+		{"empty", "06", ""},
+		// 10001 bytes are more than a script may have
+		{"oversized", "cd17" + strings.Repeat("00", 10001), "6a"},
+	}
+	
+	for _, test := range tests {
+		raw, _ := hex.DecodeString(test.raw + "ff")
+		r := bytes.NewReader(raw)
+		got, err := readCompressedScript(r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if hex.EncodeToString(got) != test.want || r.Len() != 1 {
+			t.Errorf("%s: got %x with %d bytes left", test.name, got, r.Len())
+		}
+	}
+	
+	for _, raw := range []string{"", "00" + hash[:20], "04" + strings.Repeat("ff", 32), "28" + p2wsh[:20]} {
+		b, _ := hex.DecodeString(raw)
+		if got, err := readCompressedScript(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: got script %x", raw, got)
+		}
+	}
+}
+
+func TestReadBlockUndo(t *testing.T) {
+	b := &block{Tx: []*transaction{
+		{Txid: "aa", Vin: []*txIn{{Coinbase: true}}},
+		{Txid: "bb", Vin: []*txIn{{Txid: "cc"}, {Txid: "dd", Vout: 1}}},
+	}}
+	
+	// a coinbase output of block 100 (50 btc) and an output of block 0x80 (0.01 btc), with the dummy versions
+	undo := "0102" + "8049" + "00" + "32" + "00" + strings.Repeat("11", 20) + "8100" + "00" + "07" + "28" + "0020" + strings.Repeat("33", 32)
+	raw, _ := hex.DecodeString(undo)
+	if err := readBlockUndo(raw, b); err != nil {
+		t.Fatal(err)
+	}
+	if out := b.Tx[1].Vin[0].PrevOut; out == nil || out.Value != 5000000000 || hex.EncodeToString(out.PkScript) != "76a914" + strings.Repeat("11", 20) + "88ac" {
+		t.Errorf("got first spent output %+v", out)
+	}
+	if out := b.Tx[1].Vin[1].PrevOut; out == nil || out.Value != 1000000 || hex.EncodeToString(out.PkScript) != "0020" + strings.Repeat("33", 32) {
+		t.Errorf("got second spent output %+v", out)
+	}
+	
+	// undo data of another block
+	for _, bad := range []string{"00", "0101" + undo[6:], "0102" + "8049"} {
+		raw, _ := hex.DecodeString(bad)
+		if err := readBlockUndo(raw, b); err == nil {
+			t.Errorf("%s: undo data accepted", bad)
+		}
+	}
+}
+
+func TestCachedSourceForget(t *testing.T) {
+	orphan := &block{Hash: strings.Repeat("0a", 32), Tx: []*transaction{{Txid: "aa", Vout: []*txOut{{Value: 1}, {Value: 2}}}}}
+	kept := &block{Hash: strings.Repeat("0b", 32), Tx: []*transaction{{Txid: "bb", Vout: []*txOut{{Value: 3}}}}}
+	cache := newCachedSource(&testSource{blocks: []*block{kept, orphan}}, 10, 5).(*cachedSource)
+	
+	for _, b := range []*block{kept, orphan} {
+		h, _ := chainhash.NewHashFromStr(b.Hash)
+		if _, err := cache.Block(context.Background(), h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	cache.forget(orphan.Hash)
+	
+	if out := cache.cachedPrevOut(&txIn{Txid: "aa", Vout: 1}); out != nil {
+		t.Errorf("output of the orphaned block is still cached")
+	}
+	if out := cache.cachedPrevOut(&txIn{Txid: "bb", Vout: 0}); out == nil || out.Value != 3 {
+		t.Errorf("output of the kept block is not cached")
+	}
+}
+
+func TestCachedSourceDisabled(t *testing.T) {
+	src := &testSource{}
+	for _, size := range []int{0, -1} {
+		if cache := newCachedSource(src, size, 5); cache != blockSource(src) {
+			t.Errorf("size %d: got %T, want the source itself", size, cache)
+		}
+	}
+}
+
+// htlcSpendTx returns a transaction spending p2wsh outputs with htlcScript by the hashlock branch
+func htlcSpendTx(t *testing.T, txid string, inputs int) *transaction {
+	t.Helper()
+	
+	htlc := scriptOf(t, htlcScript)
+	scriptHash := sha256.Sum256(htlc)
+	pkScript := append([]byte{txscript.OP_0, txscript.OP_DATA_32}, scriptHash[:]...)
+	
+	tx := &transaction{Txid: txid, Version: 2, VSize: 150, Vout: []*txOut{{Value: 90000 * int64(inputs), PkScript: pkScript}}}
+	for i := 0; i < inputs; i++ {
+		tx.Vin = append(tx.Vin, &txIn{
+			Txid: strings.Repeat("f0", 32),
+			Vout: uint32(i),
+			Witness: [][]byte{make([]byte, 71), make([]byte, 32), {1}, htlc},
+			Sequence: 0xffffffff,
+			PrevOut: &txOut{Value: 100000, PkScript: pkScript},
+		})
+	}
+	
+	return tx
+}
+
+func TestScannerRun(t *testing.T) {
+	useRules(t, "BTC")
+	
+	times := make([]int64, 40)
+	for h := range times {
+		times[h] = 1546300800 + int64(h) * 600
+	}
+	src := newTestChain(times...)
+	// HTLC spends in some of the blocks, every other one with two inputs
+	for _, h := range []int{3, 4, 11, 17, 18, 25, 31, 39} {
+		src.blocks[h].Tx = append(src.blocks[h].Tx, htlcSpendTx(t, fmt.Sprintf("%064x", 1000 + h), 1 + h % 2))
+	}
+	
+	// run scans blocks 1 to 39 with the parts of scan and returns the output
+	run := func(dir string, scan *checkpoint, workers int) string {
+		t.Helper()
+		
+		out, err := openTruncated(filepath.Join(dir, "HTLCsBTC.json"), scan.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		
+		s := &scanner{
+			src: src,
+			scan: scan,
+			cpFileName: filepath.Join(dir, "checkpointBTC.json"),
+			partDir: filepath.Join(dir, "HTLCsBTC.json.parts"),
+			out: out,
+			seen: make(map[string]int64),
+		}
+		if err := s.run(context.Background(), workers); err != nil {
+			t.Fatal(err)
+		}
+		
+		if len(scan.Ranges) != 0 {
+			t.Errorf("%d parts are left", len(scan.Ranges))
+		}
+		if parts, err := ioutil.ReadDir(s.partDir); err != nil || len(parts) != 0 {
+			t.Errorf("%d part files are left: %v", len(parts), err)
+		}
+		
+		raw, err := ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		return string(raw)
+	}
+	newScan := func(forward bool) *checkpoint {
+		return &checkpoint{From: 1, To: 39, Forward: forward, Ranges: splitRange(1, 39, forward, 5)}
+	}
+	
+	for _, forward := range []bool{true, false} {
+		want := run(t.TempDir(), newScan(forward), 1)
+		
+		// every input once in scan order
+		var candidates []*candidate
+		for _, line := range strings.Split(strings.TrimSpace(want), "\n") {
+			c := new(candidate)
+			if err := json.Unmarshal([]byte(line), c); err != nil {
+				t.Fatal(err)
+			}
+			candidates = append(candidates, c)
+		}
+		if len(candidates) != 14 {
+			t.Fatalf("forward=%v: got %d candidates, want 14", forward, len(candidates))
+		}
+		keys := make(map[string]bool)
+		for i, c := range candidates {
+			key := inputKey(c.Transaction, c.InputIndex)
+			if keys[key] {
+				t.Errorf("forward=%v: input %s is written twice", forward, key)
+			}
+			keys[key] = true
+			
+			if i > 0 && (c.Block > candidates[i - 1].Block) != forward && c.Block != candidates[i - 1].Block {
+				t.Errorf("forward=%v: block %d follows block %d", forward, c.Block, candidates[i - 1].Block)
+			}
+		}
+		
+		// the parts are merged in scan order however the workers finish
+		for _, workers := range []int{2, 4, 8} {
+			if got := run(t.TempDir(), newScan(forward), workers); got != want {
+				t.Errorf("forward=%v with %d workers: got\n%s\nwant\n%s", forward, workers, got, want)
+			}
+		}
+	}
+	
+	// continue an interrupted scan
+	want := run(t.TempDir(), newScan(true), 1)
+	encode := func(heights ...int) []byte {
+		t.Helper()
+		
+		var raw []byte
+		for _, h := range heights {
+			candidates, err := findHTLCs(context.Background(), src, src.blocks[h])
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := encodeCandidates(candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw = append(raw, encoded...)
+		}
+		
+		return raw
+	}
+	
+	dir := t.TempDir()
+	scan := newScan(true)
+	partDir := filepath.Join(dir, "HTLCsBTC.json.parts")
+	if err := os.MkdirAll(partDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePart := func(r *scanRange, raw []byte) {
+		t.Helper()
+		
+		if err := ioutil.WriteFile(filepath.Join(partDir, fmt.Sprintf("%d-%d.json", r.From, r.To)), raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// blocks 1 to 5 are in the output, 6 to 10 are done
+	first := encode(3, 4)
+	if err := ioutil.WriteFile(filepath.Join(dir, "HTLCsBTC.json"), first, 0644); err != nil {
+		t.Fatal(err)
+	}
+	scan.Ranges = scan.Ranges[1:]
+	scan.Height, scan.Hash, scan.Offset = 5, src.blocks[5].Hash, int64(len(first))
+	writePart(scan.Ranges[0], nil)
+	scan.Ranges[0].Height, scan.Ranges[0].Hash, scan.Ranges[0].Done = 10, src.blocks[10].Hash, true
+	
+	// 11 to 15 stopped after block 11 while writing the candidates of a later block
+	part := encode(11)
+	writePart(scan.Ranges[1], append(part, `{"block":12,"transact`...))
+	scan.Ranges[1].Height, scan.Ranges[1].Hash, scan.Ranges[1].Offset = 11, src.blocks[11].Hash, int64(len(part))
+	
+	// 16 to 20 stopped after block 18, which was replaced by a block with another spend of the HTLC
+	stale := encode(18)
+	stale = bytes.Replace(stale, []byte(src.blocks[18].Hash), []byte(strings.Repeat("ee", 32)), -1)
+	stale = bytes.Replace(stale, []byte(fmt.Sprintf("%064x", 1018)), []byte(strings.Repeat("dd", 32)), -1)
+	part = append(encode(17), stale...)
+	writePart(scan.Ranges[2], part)
+	scan.Ranges[2].Height, scan.Ranges[2].Hash, scan.Ranges[2].Offset = 18, strings.Repeat("ee", 32), int64(len(part))
+	
+	if got := run(dir, scan, 3); got != want {
+		t.Errorf("continued scan: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTransactionFee(t *testing.T) {
+	// the sigma spends of zcoin take value out of a pool
+	useRules(t, "XZC")
+	
+	funding := &block{Hash: strings.Repeat("0f", 32), Tx: []*transaction{{Txid: "aa", Vout: []*txOut{{Value: 100000}, {Value: 50000}}}}}
+	src := &testSource{blocks: []*block{funding}, outs: map[string]*txOut{outPointKey("aa", 0): {Value: 100000}}}
+	cache := newCachedSource(src, 10, 5)
+	if _, err := cache.Block(context.Background(), mustHash(t, funding.Hash)); err != nil {
+		t.Fatal(err)
+	}
+	
+	tests := []struct {
+		name string
+		src  blockSource
+		tx   *transaction
+		fee  int64
+		ok   bool
+	}{
+		{
+			"spent outputs known",
+			src,
+			&transaction{Vin: []*txIn{{PrevOut: &txOut{Value: 100000}}, {PrevOut: &txOut{Value: 50000}}}, Vout: []*txOut{{Value: 140000}}},
+			10000, true,
+		},
+		{
+			"spent output in the cache",
+			cache,
+			&transaction{Vin: []*txIn{{Txid: "aa", Vout: 0}, {PrevOut: &txOut{Value: 50000}}}, Vout: []*txOut{{Value: 140000}}},
+			10000, true,
+		},
+		// the node is not asked for the output
+		{
+			"spent output not in the cache",
+			cache,
+			&transaction{Vin: []*txIn{{PrevOut: &txOut{Value: 50000}}, {Txid: "aa", Vout: 2}}, Vout: []*txOut{{Value: 140000}}},
+			0, false,
+		},
+		{
+			"spent output without cache",
+			src,
+			&transaction{Vin: []*txIn{{Txid: "aa", Vout: 0}}, Vout: []*txOut{{Value: 90000}}},
+			0, false,
+		},
+		{
+			"coinbase",
+			cache,
+			&transaction{Vin: []*txIn{{Coinbase: true, Txid: "aa", Vout: 2}}, Vout: []*txOut{{Value: 625000000}}},
+			0, true,
+		},
+		{
+			"sigma spend",
+			src,
+			&transaction{Vin: []*txIn{{ScriptSig: []byte{0xc4, 0x01}}, {PrevOut: &txOut{Value: 50000}}}, Vout: []*txOut{{Value: 140000}}},
+			0, false,
+		},
+		// zcash: value moved out of the shielded pools adds to the fee, value moved into them is subtracted
+		{
+			"sapling",
+			src,
+			&transaction{Vin: []*txIn{{PrevOut: &txOut{Value: 100000}}}, Vout: []*txOut{{Value: 150000}}, ValueBalanceSapling: 60000},
+			10000, true,
+		},
+		{
+			"orchard and sprout",
+			src,
+			&transaction{Vin: []*txIn{{PrevOut: &txOut{Value: 100000}}}, Vout: []*txOut{{Value: 40000}}, ValueBalanceOrchard: -50000, VPubOld: 20000, VPubNew: 30000},
+			20000, true,
+		},
+		{
+			"shielded inputs only",
+			src,
+			&transaction{Vout: []*txOut{{Value: 90000}}, ValueBalanceSapling: 100000},
+			10000, true,
+		},
+	}
+	
+	for _, test := range tests {
+		fee, ok := transactionFee(test.src, test.tx)
+		if fee != test.fee || ok != test.ok {
+			t.Errorf("%s: got fee %d (%v), want %d (%v)", test.name, fee, ok, test.fee, test.ok)
+		}
+	}
+	
+	// the chain decides where the fee is, not the first output
+	p2wpkh := append([]byte{0x00, 0x14}, make([]byte, 20)...)
+	explicit := &transaction{
+		Vin: []*txIn{{PrevOut: &txOut{Asset: "6f", Value: 100000}}},
+		Vout: []*txOut{{PkScript: p2wpkh, Asset: "6f", Value: 90000}, {Asset: "6f", Value: 300}},
+	}
+	unblinded := &transaction{
+		Vin: []*txIn{{Txid: "aa", Vout: 1}},
+		Vout: []*txOut{{PkScript: p2wpkh, Value: 1000}, {PkScript: p2wpkh, Blinded: true}, {Value: 48}},
+	}
+	if fee, ok := transactionFee(src, explicit); !ok || fee != 9700 {
+		t.Errorf("XZC: got fee %d (%v) of a transaction with assets, want 9700", fee, ok)
+	}
+	
+	useRules(t, "LBTC")
+	if fee, ok := transactionFee(src, explicit); !ok || fee != 300 {
+		t.Errorf("LBTC: got fee %d (%v), want the fee output of 300", fee, ok)
+	}
+	if fee, ok := transactionFee(src, unblinded); !ok || fee != 48 {
+		t.Errorf("LBTC: got fee %d (%v) of a transaction with an unblinded first output, want 48", fee, ok)
+	}
+}
+
+func TestCandidateFields(t *testing.T) {
+	useRules(t, "BTC")
+	
+	b := &block{Hash: strings.Repeat("0b", 32), Height: 700000, Time: 1631000000}
+	
+	tx := htlcSpendTx(t, "aa", 2)
+	tx.LockTime = 699990
+	tx.VSize = 237
+	tx.Vin[1].Vout = 7
+	tx.Vin[1].Sequence = 0xfffffffd
+	candidates, err := findTxHTLCs(context.Background(), &testSource{}, b, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("got %d candidates, want 2", len(candidates))
+	}
+	
+	c := candidates[1]
+	if c.Block != 700000 || c.BlockHash != b.Hash || c.Transaction != "aa" || c.Version != 2 || c.LockTime != 699990 || c.VSize != 237 {
+		t.Errorf("got transaction fields %+v", c)
+	}
+	if c.InputIndex != 1 || c.InputTx != strings.Repeat("f0", 32) || c.InputVout != 7 || c.Sequence != 0xfffffffd || c.InputValue != 0.001 {
+		t.Errorf("got input fields %+v", c)
+	}
+	if c.PrevScript != hex.EncodeToString(tx.Vin[1].PrevOut.PkScript) || !strings.HasPrefix(c.PrevScript, "0020") {
+		t.Errorf("got prev script %s", c.PrevScript)
+	}
+	// both inputs of 0.001 pay 0.0009 each
+	for _, c := range candidates {
+		if c.Fee == nil || *c.Fee != 0.0002 {
+			t.Errorf("input %d: got fee %v, want 0.0002", c.InputIndex, c.Fee)
+		}
+	}
+	
+	// an input whose spent output is not known leaves the fee out, the output is not looked up
+	tx = htlcSpendTx(t, "bb", 1)
+	tx.Vin = append(tx.Vin, &txIn{Txid: "cc", Vout: 3})
+	src := &testSource{outs: map[string]*txOut{outPointKey("cc", 3): {Value: 5000}}}
+	if candidates, err = findTxHTLCs(context.Background(), src, b, tx); err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].Fee != nil {
+		t.Errorf("got candidates %+v, want one without fee", candidates)
+	}
+	
+	// the fee is left out of the json without it
+	raw, err := json.Marshal(candidates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"vsize":150`, `"input_vout":0`, `"sequence":4294967295`, `"prev_script":"0020`} {
+		if !bytes.Contains(raw, []byte(field)) {
+			t.Errorf("%s is missing in %s", field, raw)
+		}
+	}
+	if bytes.Contains(raw, []byte(`"fee"`)) {
+		t.Errorf("got a fee in %s", raw)
+	}
+}
+
+func TestReadCandidates(t *testing.T) {
+	complete := `{"block":10,"transaction":"aa","input_index":0}` + "\n" + `{"block":11,"transaction":"bb","input_index":1}` + "\n"
+	
+	tests := []struct {
+		name  string
+		raw   string
+		// the transactions read and the size of the complete part
+		txids string
+		size  int
+	}{
+		{"empty", "", "", 0},
+		{"complete", complete, "aa bb", len(complete)},
+		{"torn last line", complete + `{"block":12,"transac`, "aa bb", len(complete)},
+		{"last line without newline", complete + `{"block":12,"transaction":"cc","input_index":0}`, "aa bb", len(complete)},
+		{"invalid middle line", `{"block":10,"transaction":"aa","input_index":0}` + "\n" + `{"block":11,` + "\n" + `{"block":12,"transaction":"cc","input_index":0}` + "\n", "aa", 48},
+	}
+	
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "HTLCsBTC.json")
+		if err := ioutil.WriteFile(fileName, []byte(test.raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+		
+		candidates, size, err := readCandidates(fileName)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var txids []string
+		for _, c := range candidates {
+			txids = append(txids, c.Transaction)
+		}
+		if strings.Join(txids, " ") != test.txids || size != int64(test.size) {
+			t.Errorf("%s: got %q and size %d, want %q and %d", test.name, txids, size, test.txids, test.size)
+		}
+	}
+	
+	// a missing file has no candidates
+	if candidates, size, err := readCandidates(filepath.Join(t.TempDir(), "HTLCsBTC.json")); err != nil || len(candidates) != 0 || size != 0 {
+		t.Errorf("missing file: got %d candidates, size %d and %v", len(candidates), size, err)
+	}
+}
+
+func TestOpenTruncated(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "HTLCsBTC.json")
+	if err := ioutil.WriteFile(fileName, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// an offset beyond the end means the file lost data the checkpoint refers to
+	if f, err := openTruncated(fileName, 11); err == nil {
+		f.Close()
+		t.Fatal("opened a file shorter than the offset")
+	}
+	
+	// anything behind the offset is removed and writes are appended
+	f, err := openTruncated(fileName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	
+	if f, err = openTruncated(fileName, 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	
+	if raw, err := ioutil.ReadFile(fileName); err != nil || string(raw) != "0123abc" {
+		t.Errorf("got %q, %v", raw, err)
+	}
+	
+	// a missing file is created
+	missing := filepath.Join(t.TempDir(), "HTLCsLTC.json")
+	if f, err = openTruncated(missing, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(missing); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConvertLegacyOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		converted bool
+		txids     string
+	}{
+		{"array", `[{"block":10,"transaction":"aa","input_index":0},` + "\n" + `{"block":11,"transaction":"bb","input_index":1}]`, true, "aa bb"},
+		// older versions were often stopped before closing the array
+		{"unclosed array", "[\n" + `{"block":10,"transaction":"aa","input_index":0},` + "\n" + `{"block":11,"transaction":"bb","inp`, true, "aa"},
+		{"empty array", " []\n", true, ""},
+		{"lines", `{"block":10,"transaction":"aa","input_index":0}` + "\n", false, "aa"},
+		{"empty", "", false, ""},
+	}
+	
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "HTLCsBTC.json")
+		if err := ioutil.WriteFile(fileName, []byte(test.raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+		
+		converted, err := convertLegacyOutput(fileName)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if converted != test.converted {
+			t.Errorf("%s: converted is %v", test.name, converted)
+		}
+		
+		candidates, size, err := readCandidates(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var txids []string
+		for _, c := range candidates {
+			txids = append(txids, c.Transaction)
+		}
+		if strings.Join(txids, " ") != test.txids {
+			t.Errorf("%s: got %q, want %q", test.name, txids, test.txids)
+		}
+		
+		// the old file is kept next to the converted one
+		legacy, err := ioutil.ReadFile(fileName + ".legacy")
+		switch {
+		case test.converted && (err != nil || string(legacy) != test.raw):
+			t.Errorf("%s: got legacy file %q, %v", test.name, legacy, err)
+		case !test.converted && !os.IsNotExist(err):
+			t.Errorf("%s: legacy file written", test.name)
+		}
+		if info, err := os.Stat(fileName); test.converted && (err != nil || info.Size() != size) {
+			t.Errorf("%s: the converted file has more than the candidates", test.name)
+		}
+	}
+	
+	if converted, err := convertLegacyOutput(filepath.Join(t.TempDir(), "HTLCsBTC.json")); converted || err != nil {
+		t.Errorf("missing file: got %v, %v", converted, err)
+	}
+}
+
+func TestScannerSeen(t *testing.T) {
+	out, err := ioutil.TempFile(t.TempDir(), "HTLCs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	
+	s := &scanner{
+		scan: &checkpoint{From: 10, To: 20, Ranges: []*scanRange{{From: 10, To: 20}}},
+		out: out,
+		seen: make(map[string]int64),
+	}
+	
+	// the same input found twice, e.g. by an earlier run over an overlapping range, and another input of the transaction
+	candidates := []*candidate{
+		{Block: 15, Transaction: "aa", InputIndex: 0, SpendType: "p2sh"},
+		{Block: 15, Transaction: "aa", InputIndex: 0, SpendType: "p2wsh"},
+		{Block: 15, Transaction: "aa", InputIndex: 1},
+	}
+	if err := s.write(candidates); err != nil {
+		t.Fatal(err)
+	}
+	
+	written, _, err := readCandidates(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || written[0].SpendType != "p2sh" || written[1].InputIndex != 1 {
+		t.Errorf("got %+v", written)
+	}
+	
+	// once the range is merged its blocks are not scanned again
+	s.scan.Ranges = nil
+	s.prune()
+	if len(s.seen) != 0 {
+		t.Errorf("%d inputs are kept after the range was merged", len(s.seen))
+	}
+}
+
+func TestHeightAtTime(t *testing.T) {
+	// a block every ten minutes, one with a timestamp before the one of its parent
+	times := make([]int64, 1000)
+	for h := range times {
+		times[h] = 1546300800 + int64(h) * 600
+	}
+	times[500] = times[499] - 60
+	src := newTestChain(times...)
+	
+	tests := []struct {
+		time   int64
+		height int64
+	}{
+		{0, 0},
+		{times[0], 0},
+		{times[0] + 1, 1},
+		{times[1], 1},
+		{times[123] - 1, 123},
+		{times[123], 123},
+		{times[998] + 300, 999},
+		{times[999], 999},
+		// after the best block
+		{times[999] + 1, 1000},
+		// the search does not look behind the block with the earlier timestamp
+		{times[499] - 60, 499},
+		{times[501], 501},
+	}
+	
+	for _, test := range tests {
+		h, err := heightAtTime(context.Background(), src, time.Unix(test.time, 0), 999)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != test.height {
+			t.Errorf("%v: got height %d, want %d", time.Unix(test.time, 0).UTC(), h, test.height)
+		}
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	// a block each day of january 2019 at midnight
+	times := make([]int64, 10)
+	for h := range times {
+		times[h] = time.Date(2019, 1, 1 + h, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	src := newTestChain(times...)
+	
+	tests := []struct {
+		from string
+		to   string
+		// the range by default is 0 to 9
+		want []int64
+		err  bool
+	}{
+		{"3", "7", []int64{3, 7}, false},
+		{"5", "", []int64{5, 9}, false},
+		{"", "5", []int64{0, 5}, false},
+		// the range ends before the block of the date
+		{"2019-01-03", "2019-01-06", []int64{2, 4}, false},
+		{"2019-01-03T12:00:00Z", "2019-01-05T00:00:01Z", []int64{3, 4}, false},
+		{"2019-01-03T01:00:00+02:00", "", []int64{2, 9}, false},
+		{"2018-06-01", "2019-01-02", []int64{0, 0}, false},
+		{"2019-01-09", "2020-01-01", []int64{8, 9}, false},
+		{"4", "2019-01-08", []int64{4, 6}, false},
+		// -from after -to
+		{"7", "3", nil, true},
+		{"2019-01-08", "2019-01-02", nil, true},
+		// no block between the dates
+		{"2019-01-03T01:00:00Z", "2019-01-03T02:00:00Z", nil, true},
+		{"yesterday", "", nil, true},
+		{"", "2019-13-01", nil, true},
+	}
+	
+	for _, test := range tests {
+		scan := &checkpoint{From: 0, To: 9}
+		err := resolveRange(context.Background(), src, test.from, test.to, 9, scan)
+		if test.err {
+			if err == nil {
+				t.Errorf("-from %q -to %q: got range %d to %d, want an error", test.from, test.to, scan.From, scan.To)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-from %q -to %q: %v", test.from, test.to, err)
+			continue
+		}
+		if scan.From != test.want[0] || scan.To != test.want[1] {
+			t.Errorf("-from %q -to %q: got range %d to %d, want %d to %d", test.from, test.to, scan.From, scan.To, test.want[0], test.want[1])
+		}
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		from    int64
+		to      int64
+		forward bool
+		size    int64
+		// the parts as from-to in scan order
+		want    string
+	}{
+		{0, 9, true, 4, "0-3 4-7 8-9"},
+		{0, 9, false, 4, "6-9 2-5 0-1"},
+		{0, 9, true, 5, "0-4 5-9"},
+		{0, 9, false, 5, "5-9 0-4"},
+		{5, 5, true, 4, "5-5"},
+		{5, 5, false, 4, "5-5"},
+		{100, 102, true, 1000, "100-102"},
+		{100, 102, false, 1000, "100-102"},
+		// parts have at least one block
+		{7, 9, true, 0, "7-7 8-8 9-9"},
+		{7, 9, false, -1, "9-9 8-8 7-7"},
+	}
+	
+	for _, test := range tests {
+		var got []string
+		for _, r := range splitRange(test.from, test.to, test.forward, test.size) {
+			got = append(got, fmt.Sprintf("%d-%d", r.From, r.To))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%d to %d (forward=%v) in parts of %d: got %s, want %s", test.from, test.to, test.forward, test.size, strings.Join(got, " "), test.want)
+		}
+	}
+}
+
+func TestCheckpointStartAt(t *testing.T) {
+	// a height file of an older version on BCH, which scanned from the first block with CLTV
+	fileName := filepath.Join(t.TempDir(), "blockBCH.txt")
+	if err := ioutil.WriteFile(fileName, []byte("500000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := readLegacyCheckpoint(fileName, 478461)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.startAt(478559)
+	if legacy.From != 478559 || legacy.To != 500000 || legacy.Height != 500000 {
+		t.Errorf("legacy checkpoint: got %d to %d at %d", legacy.From, legacy.To, legacy.Height)
+	}
+	
+	backward := &checkpoint{From: 478461, To: 480000, Ranges: []*scanRange{
+		{From: 479000, To: 480000, Height: 479500, Hash: "aa"},
+		{From: 478501, To: 478999, Height: 478600, Hash: "bb"},
+		{From: 478461, To: 478500},
+	}}
+	backward.startAt(478559)
+	if r := backward.Ranges; backward.From != 478559 || len(r) != 2 || r[1].From != 478559 || r[1].Height != 478600 || r[1].Hash != "bb" {
+		t.Errorf("backward checkpoint: got %d with parts %+v %+v", backward.From, r[0], r[len(r) - 1])
+	}
+	
+	forward := &checkpoint{From: 478461, To: 480000, Forward: true, Height: 478500, Hash: "cc", Ranges: []*scanRange{
+		{From: 478461, To: 478540, Height: 478540, Hash: "cc", Done: true},
+		{From: 478541, To: 478640, Height: 478550, Hash: "dd", Offset: 100},
+		{From: 478641, To: 480000, Height: 479000, Hash: "ee"},
+	}}
+	forward.startAt(478559)
+	r := forward.Ranges
+	if forward.Height != 0 || forward.Hash != "" || len(r) != 2 {
+		t.Fatalf("forward checkpoint: got progress %d %q and %d parts", forward.Height, forward.Hash, len(r))
+	}
+	if r[0].From != 478559 || r[0].Hash != "" || r[0].Offset != 100 || r[1].From != 478641 || r[1].Hash != "ee" {
+		t.Errorf("forward checkpoint: got parts %+v %+v", r[0], r[1])
+	}
+	
+	// a checkpoint written since the fork is known is kept
+	since := &checkpoint{From: 478559, To: 480000, Height: 479000, Hash: "ff"}
+	since.startAt(478559)
+	if since.From != 478559 || since.Height != 479000 || since.Hash != "ff" {
+		t.Errorf("checkpoint after the fork: got %+v", since)
+	}
+}
+
+// tapleafSpend returns the spend of a tapscript leaf, with a sibling in the tree if sibling is set
+func tapleafSpend(t *testing.T, script []byte, sibling bool) *spend {
+	t.Helper()
+	
+	pops, err := parseScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	cb := &txscript.ControlBlock{LeafVersion: txscript.BaseLeafVersion}
+	if sibling {
+		cb.InclusionProof = make([]byte, txscript.ControlBlockNodeSize)
+	}
+	
+	return &spend{RedeemScript: script, RedeemOps: pops, Type: "p2tr", ControlBlock: cb}
+}
+
+// htlcScript is an HTLC with the hashlock with OP_SHA256 and a timelock with OP_CHECKSEQUENCEVERIFY
+const htlcScript = "63a8209985b2e4b9b71b28ce59ea5ce77f0b110637b625c6d7f41e982c9510940a2056882102" +
+	"1111111111111111111111111111111111111111111111111111111111111111" + "67029000b27521" + "03" +
+	"2222222222222222222222222222222222222222222222222222222222222222" + "68ac"
+
+// scriptOf decodes a hex script, a test helper
+func scriptOf(t *testing.T, s string) []byte {
+	t.Helper()
+	
+	script, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	return script
+}
+
+func TestDisasm(t *testing.T) {
+	// the asm shown by decodescript of bitcoind for these scripts
+	tests := []struct {
+		script string
+		asm    string
+	}{
+		{htlcScript, "OP_IF OP_SHA256 9985b2e4b9b71b28ce59ea5ce77f0b110637b625c6d7f41e982c9510940a2056 OP_EQUALVERIFY " +
+			"02" + strings.Repeat("11", 32) + " OP_ELSE 144 OP_CHECKSEQUENCEVERIFY OP_DROP 03" + strings.Repeat("22", 32) + " OP_ENDIF OP_CHECKSIG"},
+		// small integers
+		{"00", "0"},
+		{"4f", "-1"},
+		{"5160", "1 16"},
+		// pushes of up to 4 bytes are numbers, negative ones have the sign bit in the last byte
+		{"0181", "-1"},
+		{"0180", "0"},
+		{"02ff00", "255"},
+		{"02ff80", "-255"},
+		{"03a08601", "100000"},
+		{"04ffffffff", "-2147483647"},
+		{"05ffffffff00", "ffffffff00"},
+		// non-minimal pushes are shown like minimal ones
+		{"020100", "1"},
+		{"0110", "16"},
+		{"4c0101", "1"},
+		{"4d02000100", "1"},
+		{"0400000000", "0"},
+		{"04b1a40700", "500913"},
+		{"b175", "OP_CHECKLOCKTIMEVERIFY OP_DROP"},
+		{"a914" + strings.Repeat("00", 20) + "87", "OP_HASH160 " + strings.Repeat("00", 20) + " OP_EQUAL"},
+		{"20" + strings.Repeat("33", 32) + "ac20" + strings.Repeat("44", 32) + "ba5287", "3333333333333333333333333333333333333333333333333333333333333333 OP_CHECKSIG " +
+			"4444444444444444444444444444444444444444444444444444444444444444 OP_CHECKSIGADD 2 OP_EQUAL"},
+	}
+	
+	for _, test := range tests {
+		pops, err := parseScript(scriptOf(t, test.script))
+		if err != nil {
+			t.Errorf("%s: %v", test.script, err)
+			continue
+		}
+		if asm := strings.Join(disasm(pops), " "); asm != test.asm {
+			t.Errorf("%s: got %q, want %q", test.script, asm, test.asm)
+		}
+	}
+}
+
+func TestRedeemScript(t *testing.T) {
+	htlc := scriptOf(t, htlcScript)
+	sig := make([]byte, 71)
+	preimage := make([]byte, 32)
+	scriptHash := sha256.Sum256(htlc)
+	program := append([]byte{txscript.OP_0, txscript.OP_DATA_32}, scriptHash[:]...)
+	
+	build := func(b *txscript.ScriptBuilder) []byte {
+		script, err := b.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+	
+	tests := []struct {
+		name      string
+		in        *txIn
+		spendType string
+		stack     int
+	}{
+		{
+			"p2wsh",
+			&txIn{Witness: [][]byte{sig, preimage, {1}, htlc}},
+			spendP2WSH, 4,
+		},
+		{
+			"p2sh-p2wsh",
+			&txIn{ScriptSig: build(txscript.NewScriptBuilder().AddData(program)), Witness: [][]byte{sig, {}, htlc}},
+			spendP2SHP2WSH, 3,
+		},
+		{
+			"p2sh",
+			&txIn{ScriptSig: build(txscript.NewScriptBuilder().AddData(sig).AddData(preimage).AddOp(txscript.OP_1).AddData(htlc))},
+			spendP2SH, 4,
+		},
+		// nested p2wpkh and other scriptSigs than the push of a witness script hash
+		{"p2sh-p2wpkh", &txIn{ScriptSig: build(txscript.NewScriptBuilder().AddData(program[:22])), Witness: [][]byte{sig, htlc}}, "", 0},
+		{"p2sh-p2wsh with two pushes", &txIn{ScriptSig: build(txscript.NewScriptBuilder().AddData(program).AddData(program)), Witness: [][]byte{htlc}}, "", 0},
+		{"p2sh-p2wsh with a malformed scriptSig", &txIn{ScriptSig: []byte{txscript.OP_DATA_34, txscript.OP_0}, Witness: [][]byte{htlc}}, "", 0},
+		// short stacks
+		{"no scriptSig and no witness", &txIn{}, "", 0},
+		{"empty witness item", &txIn{Witness: [][]byte{{}}}, "", 0},
+		{"scriptSig without datapush", &txIn{ScriptSig: []byte{txscript.OP_1}}, "", 0},
+		// malformed pushes in the scriptSig and in the redeem script
+		{"push beyond the scriptSig", &txIn{ScriptSig: []byte{txscript.OP_DATA_5, 1, 2}}, "", 0},
+		{"pushdata without length", &txIn{ScriptSig: []byte{txscript.OP_PUSHDATA2, 1}}, "", 0},
+		{"malformed redeem script", &txIn{ScriptSig: []byte{txscript.OP_DATA_2, txscript.OP_PUSHDATA1, 5}}, "", 0},
+		{"malformed witness script", &txIn{Witness: [][]byte{sig, htlc[:len(htlc) - 40]}}, "", 0},
+	}
+	
+	for _, test := range tests {
+		s, ok := redeemScript(test.in)
+		if test.spendType == "" {
+			if ok {
+				t.Errorf("%s: got a %s spend of %x", test.name, s.Type, s.RedeemScript)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: no spend", test.name)
+			continue
+		}
+		if s.Type != test.spendType || len(s.Stack) != test.stack || !bytes.Equal(s.RedeemScript, htlc) || len(s.RedeemOps) != 12 {
+			t.Errorf("%s: got a %s spend with %d stack items of %x", test.name, s.Type, len(s.Stack), s.RedeemScript)
+		}
+	}
+}
+
+func TestMightBeBare(t *testing.T) {
+	pubKey := append([]byte{2}, make([]byte, 32)...)
+	sig := make([]byte, 71)
+	
+	tests := []struct {
+		name string
+		in   *txIn
+		want bool
+	}{
+		{"signature and preimage", &txIn{ScriptSig: append(append([]byte{71}, sig...), append([]byte{32}, make([]byte, 32)...)...)}, true},
+		{"signature and selector", &txIn{ScriptSig: append(append([]byte{71}, sig...), txscript.OP_0)}, true},
+		{"p2pkh", &txIn{ScriptSig: append(append([]byte{71}, sig...), append([]byte{33}, pubKey...)...)}, false},
+		// a 1 of 1 multisig redeem script
+		{"p2sh multisig", &txIn{ScriptSig: append([]byte{txscript.OP_0, 71}, append(sig, append([]byte{37, txscript.OP_1, 33}, append(pubKey, txscript.OP_1, txscript.OP_CHECKMULTISIG)...)...)...)}, false},
+		{"witness", &txIn{Witness: [][]byte{sig}}, false},
+		{"not push only", &txIn{ScriptSig: []byte{txscript.OP_1, txscript.OP_DUP}}, false},
+		{"empty scriptSig", &txIn{}, false},
+		{"push beyond the scriptSig", &txIn{ScriptSig: []byte{txscript.OP_DATA_5, 1, 2}}, false},
+		{"pushdata without length", &txIn{ScriptSig: []byte{txscript.OP_PUSHDATA4, 1, 0}}, false},
+		// the last push is no script, it is not a p2sh spend
+		{"malformed last push", &txIn{ScriptSig: []byte{txscript.OP_DATA_2, txscript.OP_PUSHDATA1, 5}}, true},
+	}
+	
+	for _, test := range tests {
+		if got := mightBeBare(test.in); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBareScript(t *testing.T) {
+	htlc := scriptOf(t, htlcScript)
+	sig := make([]byte, 71)
+	
+	tests := []struct {
+		name     string
+		in       *txIn
+		pkScript []byte
+		stack    int
+	}{
+		{"signature and preimage", &txIn{ScriptSig: append(append([]byte{71}, sig...), append([]byte{32}, make([]byte, 32)...)...)}, htlc, 3},
+		{"signature and selector", &txIn{ScriptSig: append(append([]byte{71}, sig...), txscript.OP_0)}, htlc, 3},
+		{"empty scriptSig", &txIn{}, htlc, 1},
+		{"witness", &txIn{Witness: [][]byte{sig}}, htlc, 0},
+		{"malformed scriptSig", &txIn{ScriptSig: []byte{txscript.OP_PUSHDATA1}}, htlc, 0},
+		{"malformed output script", &txIn{ScriptSig: []byte{txscript.OP_0}}, htlc[:len(htlc) - 40], 0},
+	}
+	
+	for _, test := range tests {
+		s, ok := bareScript(test.in, &txOut{PkScript: test.pkScript})
+		if test.stack == 0 {
+			if ok {
+				t.Errorf("%s: got a spend of %x", test.name, s.RedeemScript)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: no spend", test.name)
+			continue
+		}
+		if s.Type != spendBare || len(s.Stack) != test.stack || !bytes.Equal(s.Stack[len(s.Stack) - 1].Data, htlc) || len(s.RedeemOps) != 12 {
+			t.Errorf("%s: got a %s spend with %d stack items of %x", test.name, s.Type, len(s.Stack), s.RedeemScript)
+		}
+	}
+}
+
+func TestTapleafRules(t *testing.T) {
+	useRules(t, "BTC")
+	
+	pubKey := make([]byte, 32)
+	hash := make([]byte, 32)
+	build := func(b *txscript.ScriptBuilder) []byte {
+		script, err := b.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+	
+	tests := []struct {
+		name    string
+		script  []byte
+		sibling bool
+		// the names of the matched rules
+		want    string
+	}{
+		{
+			"hashlock with sibling",
+			build(txscript.NewScriptBuilder().AddOp(txscript.OP_SHA256).AddData(hash).AddOp(txscript.OP_EQUALVERIFY).
+				AddData(pubKey).AddOp(txscript.OP_CHECKSIG)),
+			true, "tapleaf-sibling",
+		},
+		{
+			"hashlock without sibling",
+			build(txscript.NewScriptBuilder().AddOp(txscript.OP_SHA256).AddData(hash).AddOp(txscript.OP_EQUALVERIFY).
+				AddData(pubKey).AddOp(txscript.OP_CHECKSIG)),
+			false, "",
+		},
+		{
+			"hashlock and timelock in one leaf",
+			build(txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).AddData(hash[:20]).AddOp(txscript.OP_EQUALVERIFY).
+				AddData(pubKey).AddOp(txscript.OP_CHECKSIGVERIFY).AddInt64(144).AddOp(txscript.OP_CHECKSEQUENCEVERIFY)),
+			false, "htlc,tapleaf",
+		},
+		{
+			"timelock without hashlock",
+			build(txscript.NewScriptBuilder().AddData(pubKey).AddOp(txscript.OP_CHECKSIG).
+				AddInt64(144).AddOp(txscript.OP_CHECKSEQUENCEVERIFY)),
+			true, "",
+		},
+		{
+			"hash of another size",
+			build(txscript.NewScriptBuilder().AddOp(txscript.OP_SHA256).AddData(hash[:16]).AddOp(txscript.OP_EQUALVERIFY).
+				AddData(pubKey).AddOp(txscript.OP_CHECKSIG)),
+			true, "",
+		},
+	}
+	
+	for _, test := range tests {
+		var names []string
+		for _, r := range matchRules(tapleafSpend(t, test.script, test.sibling)) {
+			names = append(names, r.Name)
+		}
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%s: matched rules %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRuleOpcodesOfChain(t *testing.T) {
+	chains, err := registry.Read("chains.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	raw := `[{"name": "sha256", "required": [["OP_SHA256"]]}, {"name": "blake256", "required": [["OP_BLAKE256"]]}]`
+	if err := ioutil.WriteFile(fileName, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// 0xa8 is OP_SHA256 on bitcoin and OP_BLAKE256 on decred, which has OP_SHA256 at 0xc0
+	tests := []struct {
+		chain  string
+		script []byte
+		want   string
+	}{
+		{"BTC", []byte{0xa8}, "sha256"},
+		{"BTC", []byte{0xc0}, ""},
+		{"DCR", []byte{0xc0}, "sha256"},
+		{"DCR", []byte{0xa8}, "blake256"},
+	}
+	
+	for _, test := range tests {
+		chainRules, err := readRules(fileName, registry.Find(chains, test.chain), chains)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		pops, err := parseScript(test.script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		var names []string
+		for _, r := range chainRules {
+			if r.match(&spend{RedeemOps: pops, Type: "p2sh"}) {
+				names = append(names, r.Name)
+			}
+		}
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%s %x: matched rules %q, want %q", test.chain, test.script, got, test.want)
+		}
+	}
+}
+
+func TestDecredContract(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "dcr_redeem.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// the redeem of a contract hashing the secret with OP_SHA256, which is 0xc0 on decred
+	tx, err := newDecredTransaction(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Tree = decredTree(tx)
+	b := &block{Height: 700010, Tx: []*transaction{tx}}
+	
+	find := func(chain string, version uint16) []*candidate {
+		useRules(t, chain)
+		
+		src := &testSource{outs: map[string]*txOut{
+			outPointKey(tx.Vin[0].Txid, 0): {Value: 50000000, Version: version},
+		}}
+		candidates, err := findTxHTLCs(context.Background(), src, b, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return candidates
+	}
+	
+	candidates := find("DCR", 0)
+	if len(candidates) != 1 {
+		t.Fatalf("got %d candidates, want 1", len(candidates))
+	}
+	c := candidates[0]
+	if c.Expiry != 700100 || c.Tree != 0 || c.InputValue != 0.5 || strings.Join(c.Rules, ",") != "htlc" {
+		t.Errorf("got candidate %+v", c)
+	}
+	// the contract is the last item of the stack
+	if len(c.Asm) != 4 || !strings.HasPrefix(c.Asm[3], "63c020") {
+		t.Errorf("got asm %q", c.Asm)
+	}
+	
+	// on bitcoin 0xc0 is no hash opcode
+	if candidates := find("BTC", 0); len(candidates) != 0 {
+		t.Errorf("got %d candidates with the opcodes of bitcoin", len(candidates))
+	}
+	
+	// scripts of other versions are not parsed
+	if candidates := find("DCR", 1); len(candidates) != 0 {
+		t.Errorf("got %d candidates for script version 1", len(candidates))
+	}
+}
+
+func TestIsRefund(t *testing.T) {
+	sig := parsedOp{Opcode: 72, Data: make([]byte, 72)}
+	script := parsedOp{Opcode: txscript.OP_PUSHDATA1, Data: []byte{txscript.OP_IF}}
+	
+	tests := []struct {
+		name     string
+		selector parsedOp
+		lockTime uint32
+		sequence uint32
+		want     bool
+	}{
+		{"else branch with locktime", parsedOp{Opcode: txscript.OP_0}, 500000, 0xfffffffe, true},
+		{"final sequence ignores the locktime", parsedOp{Opcode: txscript.OP_0}, 500000, 0xffffffff, false},
+		{"no locktime", parsedOp{Opcode: txscript.OP_0}, 0, 0xfffffffe, false},
+		{"if branch", parsedOp{Opcode: txscript.OP_1}, 500000, 0xfffffffe, false},
+	}
+	
+	for _, test := range tests {
+		s := &spend{Stack: []parsedOp{sig, sig, test.selector, script}}
+		tx := &transaction{LockTime: test.lockTime}
+		if got := isRefund(s, tx, &txIn{Sequence: test.sequence}); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLightningScript(t *testing.T) {
+	// the keys and payment hashes of the commitment transaction with five HTLCs of BOLT 3 appendix C,
+	// the htlc scripts of appendix F (anchors) end with 1 OP_CHECKSEQUENCEVERIFY OP_DROP
+	const (
+		revocationHash = "14011f7254d96b819c76986c277d115efce6f7b5"
+		remoteHTLCKey  = "0394854aa6eab5b2a8122cc726e9dded053a2184d88256816826d6231c068d4a5b"
+		localHTLCKey   = "030d417a46946384f88d5f3337267c5e579765875dc4daca813e21734b140639e7"
+		revocationKey  = "0212a140cd0c6539d07cd08dfe09984dec3251ea808b892efeac3ede9402bf2b19"
+		delayedKey     = "03fd5960528dc152014952efdb702a88f71e3c1653b2314431701ec77e57fde83c"
+		fundingKey     = "023da092f6980e58d2c037173180e9a465476026ee50f96695963e8efe436f54a2"
+		anchorEnd      = "51b275"
+	)
+	offered := func(paymentHash, end string) string {
+		return "76a914" + revocationHash + "8763ac6721" + remoteHTLCKey + "7c820120876475527c21" + localHTLCKey +
+			"52ae67a914" + paymentHash + "88ac68" + end + "68"
+	}
+	received := func(paymentHash, expiry, end string) string {
+		return "76a914" + revocationHash + "8763ac6721" + remoteHTLCKey + "7c8201208763a914" + paymentHash +
+			"88527c21" + localHTLCKey + "52ae677502" + expiry + "b175ac68" + end + "68"
+	}
+	
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"htlc 0", received("b8bcb07f6344b42ab04250c86a6e8b75d3fdbbc6", "f401", ""), "received-htlc"},
+		{"htlc 1", received("4b6b2e5444c2639cc0fb7bcea5afba3f3cdce239", "f501", ""), "received-htlc"},
+		{"htlc 2", offered("b43e1b38138a41b37f7cd9a1d274bc63e3a9b5d1", ""), "offered-htlc"},
+		{"htlc 3", offered("8a486ff2e31d6158bf39e2608864d63fefd09d5b", ""), "offered-htlc"},
+		{"htlc 4", received("18bc1a114ccf9c052d3d23e28d3b0a9d12274342", "f801", ""), "received-htlc"},
+		{"htlc 1 with anchors", received("4b6b2e5444c2639cc0fb7bcea5afba3f3cdce239", "f501", anchorEnd), "received-htlc"},
+		{"htlc 2 with anchors", offered("b43e1b38138a41b37f7cd9a1d274bc63e3a9b5d1", anchorEnd), "offered-htlc"},
+		{"to_local", "6321" + revocationKey + "67029000b27521" + delayedKey + "68ac", "to-local"},
+		{"anchor", "21" + fundingKey + "ac736460b268", "anchor"},
+		// near misses: 2 OP_CHECKSEQUENCEVERIFY, OP_CHECKLOCKTIMEVERIFY instead of OP_CHECKSEQUENCEVERIFY,
+		// the closing OP_ENDIF or the OP_DROP of the delay missing and the to_remote script of channels with anchors
+		{"htlc 2 with a delay of 2", offered("b43e1b38138a41b37f7cd9a1d274bc63e3a9b5d1", "52b275"), ""},
+		{"htlc 2 with a locktime", offered("b43e1b38138a41b37f7cd9a1d274bc63e3a9b5d1", "51b175"), ""},
+		{"htlc 0 without the last OP_ENDIF", strings.TrimSuffix(received("b8bcb07f6344b42ab04250c86a6e8b75d3fdbbc6", "f401", ""), "68"), ""},
+		{"to_local without OP_DROP", "6321" + revocationKey + "67029000b221" + delayedKey + "68ac", ""},
+		{"to_remote", "21" + remoteHTLCKey + "ad51b2", ""},
+	}
+	
+	for _, test := range tests {
+		script, err := hex.DecodeString(test.script)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		pops, err := parseScript(script)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := lightningScript(pops); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// zmqNote is a notification of bitcoind as recorded in testdata/zmq_btc.json
+type zmqNote struct {
+	Topic    string `json:"topic"`
+	Body     string `json:"body"`
+	Sequence uint32 `json:"sequence"`
+}
+
+// zmqPublisher is a ZMTP 3.0 publisher with the NULL mechanism, as bitcoind runs it for -zmqpub*.
+// It serves one subscriber and sends every notification, the topics are not filtered.
+type zmqPublisher struct {
+	listener net.Listener
+	// the connection of the subscriber, once it subscribed to all topics
+	conns    chan net.Conn
+}
+
+func newZMQPublisher(t *testing.T, topics int) *zmqPublisher {
+	t.Helper()
+	
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	
+	p := &zmqPublisher{listener: listener, conns: make(chan net.Conn, 1)}
+	
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		
+		if err := p.handshake(conn, topics); err != nil {
+			t.Errorf("zmq handshake: %v", err)
+			conn.Close()
+			return
+		}
+		p.conns <- conn
+	}()
+	
+	return p
+}
+
+func (p *zmqPublisher) endpoint() string {
+	return "tcp://" + p.listener.Addr().String()
+}
+
+// handshake exchanges the greetings and the READY commands and reads the subscriptions
+func (p *zmqPublisher) handshake(conn net.Conn, topics int) error {
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9], greeting[10] = 0xff, 0x7f, 3
+	copy(greeting[12:], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9] != 0x7f || string(peer[12:16]) != "NULL" {
+		return fmt.Errorf("invalid greeting %x", peer)
+	}
+	
+	flag, body, err := readZMQFrame(conn)
+	if err != nil {
+		return err
+	}
+	if flag&4 == 0 || !bytes.Contains(body, []byte("SUB")) {
+		return fmt.Errorf("expected the READY command of a subscriber, got %q", body)
+	}
+	
+	ready := append([]byte{5}, "READY"...)
+	ready = append(ready, 11)
+	ready = append(ready, "Socket-Type"...)
+	ready = append(ready, 0, 0, 0, 3)
+	ready = append(ready, "PUB"...)
+	if err := writeZMQFrame(conn, 4, ready); err != nil {
+		return err
+	}
+	
+	// a subscription is a message starting with 1 followed by the topic
+	for i := 0; i < topics; i++ {
+		_, body, err := readZMQFrame(conn)
+		if err != nil {
+			return err
+		}
+		if len(body) == 0 || body[0] != 1 {
+			return fmt.Errorf("expected a subscription, got %q", body)
+		}
+	}
+	
+	return nil
+}
+
+// send sends a notification as the topic, the body and the little endian sequence number
+func (p *zmqPublisher) send(conn net.Conn, note zmqNote) error {
+	body, err := hex.DecodeString(note.Body)
+	if err != nil {
+		return err
+	}
+	sequence := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sequence, note.Sequence)
+	
+	if err := writeZMQFrame(conn, 1, []byte(note.Topic)); err != nil {
+		return err
+	}
+	if err := writeZMQFrame(conn, 1, body); err != nil {
+		return err
+	}
+	
+	return writeZMQFrame(conn, 0, sequence)
+}
+
+func writeZMQFrame(w io.Writer, flag byte, body []byte) error {
+	header := []byte{flag, byte(len(body))}
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flag | 2
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	}
+	
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	
+	return err
+}
+
+func readZMQFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	
+	size := uint64(header[1])
+	if header[0]&2 != 0 {
+		long := make([]byte, 8)
+		long[0] = header[1]
+		if _, err := io.ReadFull(r, long[1:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(long)
+	}
+	
+	body := make([]byte, size)
+	_, err := io.ReadFull(r, body)
+	
+	return header[0], body, err
+}
+
+// waitFor polls until check is true
+func waitFor(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	
+	for deadline := time.Now().Add(10 * time.Second); !check(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// readZMQFixture returns the notifications of testdata/zmq_btc.json: the announced transaction, the hash
+// of the block which mines it and the block. The block is returned decoded at height 1.
+func readZMQFixture(t *testing.T) (*block, []zmqNote) {
+	t.Helper()
+	
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "zmq_btc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notes []zmqNote
+	if err := json.Unmarshal(raw, &notes); err != nil {
+		t.Fatal(err)
+	}
+	
+	rawBlock, err := hex.DecodeString(notes[2].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgBlock wire.MsgBlock
+	if err := msgBlock.Deserialize(bytes.NewReader(rawBlock)); err != nil {
+		t.Fatal(err)
+	}
+	b := &block{Hash: msgBlock.BlockHash().String(), Height: 1, Time: msgBlock.Header.Timestamp.Unix(), PreviousHash: msgBlock.Header.PrevBlock.String()}
+	for _, msgTx := range msgBlock.Transactions {
+		b.Tx = append(b.Tx, newTransactionFromWire(msgTx))
+	}
+	
+	return b, notes
+}
+
+func TestFollowZMQ(t *testing.T) {
+	useRules(t, "BTC")
+	
+	// the recorded block spends an HTLC with the secret, the block before it is where the scan ended
+	tip, notes := readZMQFixture(t)
+	htlcTx := tip.Tx[1]
+	
+	src := &testSource{
+		blocks: []*block{{Hash: tip.PreviousHash, Height: 0}},
+		outs: map[string]*txOut{outPointKey(htlcTx.Vin[0].Txid, htlcTx.Vin[0].Vout): {Value: 100000}},
+	}
+	
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "HTLCsBTC.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	
+	s := &scanner{
+		src: src,
+		scan: &checkpoint{To: 0},
+		cpFileName: filepath.Join(dir, "checkpointBTC.json"),
+		out: out,
+		seen: make(map[string]int64),
+		mempool: newMempool(filepath.Join(dir, "mempoolHTLCsBTC.json")),
+		wire: "bitcoin",
+	}
+	
+	publisher := newZMQPublisher(t, 3)
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	blocks := make(chan struct{}, 1)
+	txs := make(chan []byte)
+	notifier := &zmqNotifier{endpoint: publisher.endpoint(), txs: txs}
+	notified := make(chan error, 1)
+	go func() { notified <- notifier.Run(ctx, blocks) }()
+	
+	// only the notifications can wake up the loop
+	followed := make(chan error, 1)
+	go func() { followed <- s.follow(ctx, blocks, txs, time.Hour, 6) }()
+	
+	var conn net.Conn
+	select {
+	case conn = <-publisher.conns:
+	case err := <-notified:
+		t.Fatalf("the notifier stopped: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no subscriber")
+	}
+	
+	candidatesOf := func(fileName, txid string) []*candidate {
+		candidates, _, err := readCandidates(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []*candidate
+		for _, c := range candidates {
+			if c.Transaction == txid {
+				found = append(found, c)
+			}
+		}
+		return found
+	}
+	
+	// the announced transaction is an unconfirmed candidate
+	if err := publisher.send(conn, notes[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the unconfirmed candidate", func() bool {
+		return len(candidatesOf(s.mempool.fileName, htlcTx.Txid)) == 1
+	})
+	
+	// the block is processed once it is announced
+	src.add(tip)
+	for _, note := range notes[1:] {
+		if err := publisher.send(conn, note); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the candidate of the block", func() bool {
+		return len(candidatesOf(out.Name(), htlcTx.Txid)) == 1
+	})
+	
+	c := candidatesOf(out.Name(), htlcTx.Txid)[0]
+	if c.Block != 1 || c.BlockHash != tip.Hash || c.Unconfirmed || strings.Join(c.Rules, ",") != "htlc" {
+		t.Errorf("got candidate %+v", c)
+	}
+	
+	// the mined transaction is no longer unconfirmed
+	waitFor(t, "the mempool to be emptied", func() bool {
+		return len(candidatesOf(s.mempool.fileName, htlcTx.Txid)) == 0
+	})
+	
+	cancel()
+	if err := <-followed; err != context.Canceled {
+		t.Errorf("follow returned %v", err)
+	}
+	if err := <-notified; err != context.Canceled {
+		t.Errorf("the notifier returned %v", err)
+	}
+}
+
+// esploraServer replays the responses of testdata/esplora.json. The first requests of a path in failures
+// are answered with the given status codes, paths which are not recorded with 404.
+type esploraServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string]json.RawMessage
+	failures  map[string][]int
+	requests  map[string]int
+}
+
+func newEsploraServer(t *testing.T, failures map[string][]int) *esploraServer {
+	t.Helper()
+	
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "esplora.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	s := &esploraServer{failures: failures, requests: make(map[string]int)}
+	if err := json.Unmarshal(raw, &s.responses); err != nil {
+		t.Fatal(err)
+	}
+	
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		try := s.requests[r.URL.Path]
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+		
+		if codes := s.failures[r.URL.Path]; try < len(codes) {
+			http.Error(w, "try again", codes[try])
+			return
+		}
+		
+		res, ok := s.responses[r.URL.Path]
+		if !ok {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+		
+		// plain text responses like hashes and heights are recorded as json strings
+		var text string
+		if json.Unmarshal(res, &text) == nil {
+			res = json.RawMessage(text)
+		}
+		w.Write(res)
+	}))
+	t.Cleanup(s.Close)
+	
+	return s
+}
+
+func (s *esploraServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	return s.requests[path]
+}
+
+func TestMempool(t *testing.T) {
+	useRules(t, "BTC")
+	
+	// the recorded block mines the announced HTLC and a coinbase without one
+	b, _ := readZMQFixture(t)
+	htlcTx := b.Tx[1]
+	src := &testSource{
+		outs: map[string]*txOut{outPointKey(htlcTx.Vin[0].Txid, htlcTx.Vin[0].Vout): {Value: 100000}},
+		unconfirmed: b.Tx,
+	}
+	
+	m := newMempool(filepath.Join(t.TempDir(), "mempoolHTLCsBTC.json"))
+	pending := func() []*candidate {
+		t.Helper()
+		
+		if err := m.write(); err != nil {
+			t.Fatal(err)
+		}
+		candidates, _, err := readCandidates(m.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return candidates
+	}
+	
+	ctx := context.Background()
+	if err := m.update(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 1 || got[0].Transaction != htlcTx.Txid || !got[0].Unconfirmed {
+		t.Fatalf("got unconfirmed candidates %+v", got)
+	}
+	if len(m.checked) != 2 {
+		t.Errorf("%d transactions checked, want 2", len(m.checked))
+	}
+	
+	// checked transactions are not checked again, e.g. when they are announced
+	src.outs = nil
+	if err := m.check(ctx, src, htlcTx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.update(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if m.changed || len(m.pending) != 1 {
+		t.Errorf("checked transaction checked again")
+	}
+	
+	// the candidate of a mined transaction is written with its block
+	m.confirm(b)
+	if got := pending(); len(got) != 0 || len(m.checked) != 0 {
+		t.Errorf("got candidates %+v and %d checked transactions of a mined block", got, len(m.checked))
+	}
+	
+	// the candidate of an evicted transaction is dropped
+	src.outs = map[string]*txOut{outPointKey(htlcTx.Vin[0].Txid, htlcTx.Vin[0].Vout): {Value: 100000}}
+	src.unconfirmed = []*transaction{htlcTx}
+	if err := m.update(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 1 {
+		t.Fatalf("got %d unconfirmed candidates, want 1", len(got))
+	}
+	src.unconfirmed = nil
+	if err := m.update(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); len(got) != 0 || len(m.checked) != 0 {
+		t.Errorf("got candidates %+v and %d checked transactions after the eviction", got, len(m.checked))
+	}
+}
+
+func TestEsploraSource(t *testing.T) {
+	blockHash := strings.Repeat("b1", 32)
+	htlcTx := strings.Repeat("2b", 32)
+	
+	// the second page of transactions fails twice, the transaction is rate limited once
+	server := newEsploraServer(t, map[string][]int{
+		"/block/" + blockHash + "/txs/25": {http.StatusServiceUnavailable, http.StatusBadGateway},
+		"/tx/" + htlcTx: {http.StatusTooManyRequests},
+	})
+	src := newEsploraSource(server.URL + "/", 2, 3)
+	src.delay = time.Millisecond
+	ctx := context.Background()
+	
+	height, err := src.BestHeight(ctx)
+	if err != nil || height != 101 {
+		t.Fatalf("got best height %d: %v", height, err)
+	}
+	
+	h, err := src.BlockHash(ctx, 100)
+	if err != nil || h.String() != blockHash {
+		t.Fatalf("got block hash %v: %v", h, err)
+	}
+	
+	header, err := src.BlockHeader(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Height != 100 || header.Time != 1700000000 || header.PreviousHash != strings.Repeat("b0", 32) || len(header.Tx) != 0 {
+		t.Errorf("got header %+v", header)
+	}
+	
+	b, err := src.Block(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Tx) != 30 || b.NextHash != strings.Repeat("b2", 32) {
+		t.Fatalf("got %d transactions and next block %s", len(b.Tx), b.NextHash)
+	}
+	if server.count("/block/" + blockHash + "/txs/25") != 3 {
+		t.Errorf("second page requested %d times, want 3", server.count("/block/" + blockHash + "/txs/25"))
+	}
+	for i, tx := range b.Tx {
+		if want := fmt.Sprintf("%02x", 0x10 + i); i != 27 && tx.Txid != strings.Repeat(want, 32) {
+			t.Errorf("tx %d is %s", i, tx.Txid)
+		}
+	}
+	if !b.Tx[0].Vin[0].Coinbase || b.Tx[27].Txid != htlcTx || b.Tx[27].Vin[0].PrevOut == nil {
+		t.Fatalf("got transactions %+v and %+v", b.Tx[0], b.Tx[27])
+	}
+	
+	// the spent outputs come with the transactions, so the fee is known without further requests
+	useRules(t, "BTC")
+	candidates, err := findHTLCs(ctx, src, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("got %d candidates, want 1", len(candidates))
+	}
+	c := candidates[0]
+	if c.Transaction != htlcTx || c.SpendType != "p2wsh" || c.InputValue != 0.0015 || c.Fee == nil || *c.Fee != 0.00001 {
+		t.Errorf("got candidate %+v", c)
+	}
+	
+	txid, _ := chainhash.NewHashFromStr(htlcTx)
+	tx, err := src.Transaction(ctx, txid)
+	if err != nil || tx.LockTime != 99 {
+		t.Fatalf("got transaction %+v: %v", tx, err)
+	}
+	if server.count("/tx/" + htlcTx) != 2 {
+		t.Errorf("transaction requested %d times, want 2", server.count("/tx/" + htlcTx))
+	}
+	
+	// there is no block after the tip and missing blocks are not retried
+	next, _ := chainhash.NewHashFromStr(strings.Repeat("b2", 32))
+	if _, err := src.Block(ctx, next); err == nil {
+		t.Error("got a block which is not recorded")
+	}
+	if server.count("/block/" + next.String()) != 1 {
+		t.Errorf("missing block requested %d times, want 1", server.count("/block/" + next.String()))
+	}
+}
+
+func TestEsploraRetriesExhausted(t *testing.T) {
+	path := "/block-height/100"
+	server := newEsploraServer(t, map[string][]int{
+		path: {http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+	})
+	src := newEsploraSource(server.URL, 1, 2)
+	src.delay = time.Millisecond
+	
+	if _, err := src.BlockHash(context.Background(), 100); err == nil {
+		t.Fatal("got a block hash after the retries")
+	}
+	if server.count(path) != 3 {
+		t.Errorf("requested %d times, want 3", server.count(path))
+	}
+}
+
+func TestChainBlocks(t *testing.T) {
+	tests := []struct {
+		chain     string
+		fixture   string
+		txid      string
+		spendType string
+	}{
+		// merge mined, the header is followed by the auxpow
+		{"DOGE", "doge_block.hex", "d7a8f63f4b6228fb1460811eaea5212d4be9d943cdf1b4e04bacd21fa2229d4a", "p2sh"},
+		{"VTC", "vtc_block.hex", "5438ca25ddee319f79638e6421efe62cbd8221d87a06ac96b3c733621138746e", "p2wsh"},
+		{"DGB", "dgb_block.hex", "8683ad0f5a3d0d40c6a8aaba81a5518546daa718e7992452a2867bb4819eac8b", "p2sh-p2wsh"},
+	}
+	
+	for _, test := range tests {
+		c := useRules(t, test.chain)
+		
+		b, err := decodeBlock(c.Wire, readFixture(t, test.fixture))
+		if err != nil {
+			t.Fatalf("%s: %v", test.chain, err)
+		}
+		
+		src := &testSource{outs: make(map[string]*txOut)}
+		for _, tx := range b.Tx {
+			for _, in := range tx.Vin {
+				src.outs[outPointKey(in.Txid, in.Vout)] = &txOut{Value: 100000000}
+			}
+		}
+		
+		candidates, err := findHTLCs(context.Background(), src, b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.chain, err)
+		}
+		if len(candidates) != 1 {
+			t.Fatalf("%s: got %d candidates, want 1", test.chain, len(candidates))
+		}
+		
+		cand := candidates[0]
+		if cand.Transaction != test.txid || cand.SpendType != test.spendType || strings.Join(cand.Rules, ",") != "htlc" {
+			t.Errorf("%s: got candidate %+v", test.chain, cand)
+		}
+	}
+	
+	// the auxpow is no transaction
+	if _, err := decodeBlock("bitcoin", readFixture(t, "doge_block.hex")); err == nil {
+		t.Error("decoded a merge mined block without the auxpow")
+	}
+}
+
+// nodeServer replays recorded json-rpc responses, keyed by the method and its parameters.
+// Batches of requests are answered with the responses of all requests.
+type nodeServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	responses   map[string]json.RawMessage
+	// like dogecoin and zcoin only accept verbose true or false in getblock
+	boolVerbose bool
+	// the requests in the order they were received
+	requests    []string
+	// the number of http requests, a batch counts once
+	posts       int
+	// the serialized blocks of the REST interface by path
+	rest        map[string][]byte
+	// the number of http requests answered with a server error before the responses
+	failures    int
+}
+
+// nodeRequest is a json-rpc request to the nodeServer
+type nodeRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     json.RawMessage   `json:"id"`
+}
+
+func newNodeServer(t *testing.T, fixture string) *nodeServer {
+	t.Helper()
+	
+	// without a fixture the node only knows the responses added by the test
+	s := &nodeServer{responses: make(map[string]json.RawMessage)}
+	if fixture != "" {
+		raw, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, &s.responses); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		
+		s.mu.Lock()
+		s.posts++
+		fail := s.posts <= s.failures
+		s.mu.Unlock()
+		
+		if fail {
+			http.Error(w, "Work queue depth exceeded", http.StatusServiceUnavailable)
+			return
+		}
+		
+		if r.Method == "GET" {
+			raw, ok := s.rest[r.URL.Path]
+			if !ok {
+				http.Error(w, "Block not found", http.StatusNotFound)
+				return
+			}
+			w.Write(raw)
+			return
+		}
+		
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			var reqs []nodeRequest
+			if err := json.Unmarshal(body, &reqs); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res := make([]interface{}, len(reqs))
+			for i, req := range reqs {
+				res[i] = s.respond(req)
+			}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		
+		var req nodeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(s.respond(req))
+	}))
+	t.Cleanup(s.Close)
+	
+	return s
+}
+
+// respond returns the recorded response to a request
+func (s *nodeServer) respond(req nodeRequest) map[string]interface{} {
+	params, err := json.Marshal(req.Params)
+	if err != nil {
+		return map[string]interface{}{"id": req.ID, "result": nil, "error": map[string]interface{}{"code": -32700, "message": err.Error()}}
+	}
+	key := req.Method + " " + string(params)
+	
+	s.mu.Lock()
+	s.requests = append(s.requests, key)
+	result, ok := s.responses[key]
+	s.mu.Unlock()
+	
+	res := map[string]interface{}{"id": req.ID, "result": result, "error": nil}
+	switch {
+	case s.boolVerbose && req.Method == "getblock" && len(req.Params) > 1 && string(req.Params[1]) != "true" && string(req.Params[1]) != "false":
+		res["result"] = nil
+		res["error"] = map[string]interface{}{"code": -1, "message": "JSON value is not a boolean as expected"}
+	case !ok:
+		res["result"] = nil
+		res["error"] = map[string]interface{}{"code": -5, "message": "No information available about transaction"}
+	}
+	
+	return res
+}
+
+func TestBoolVerboseNodes(t *testing.T) {
+	tests := []struct {
+		chain    string
+		fixture  string
+		// how main requests the blocks of the chain
+		raw      string
+		block    string
+		height   int64
+		txid     string
+		requests []string
+	}{
+		{
+			// the serialized block is decoded, only the spent output is requested as json
+			"DOGE", "rpc_doge.json", "rpc",
+			"3e1a1f97141bba6d8c402cde09cf3d142096a350e57c1b1fc65b47aaf2e037fb", 4900000,
+			"d7a8f63f4b6228fb1460811eaea5212d4be9d943cdf1b4e04bacd21fa2229d4a",
+			[]string{"getblock", "getblockheader", "getrawtransaction"},
+		},
+		{
+			// the block is requested with the txids, then every transaction and the spent output.
+			// The input of the sigma spend spends no output and is not looked up.
+			"XZC", "rpc_xzc.json", "",
+			"a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9a9", 600001,
+			"dd2dee97dc722ed7997ae1c4fcd64ad3252d7cb105e74955957031317671803a",
+			[]string{"getblock", "getrawtransaction", "getrawtransaction", "getrawtransaction", "getrawtransaction"},
+		},
+	}
+	
+	for _, test := range tests {
+		c := useRules(t, test.chain)
+		if c.RPC.GetBlock != "bool" {
+			t.Fatalf("%s: getblock is %q in chains.json", test.chain, c.RPC.GetBlock)
+		}
+		
+		node := newNodeServer(t, test.fixture)
+		node.boolVerbose = true
+		if test.chain == "DOGE" {
+			rawBlock, err := json.Marshal(hex.EncodeToString(readFixture(t, "doge_block.hex")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			node.responses[`getblock ["` + test.block + `",false]`] = rawBlock
+		}
+		
+		src, err := newRPCSource(&rpcclient.ConnConfig{
+			HTTPPostMode: true,
+			DisableTLS: true,
+			Host: strings.TrimPrefix(node.URL, "http://"),
+			User: "user",
+			Pass: "pass",
+		}, false, 1, 0, test.raw, c.Wire, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.c.Shutdown()
+		
+		h, err := chainhash.NewHashFromStr(test.block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := src.Block(context.Background(), h)
+		if err != nil {
+			t.Fatalf("%s: %v", test.chain, err)
+		}
+		candidates, err := findHTLCs(context.Background(), src, b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.chain, err)
+		}
+		
+		if len(candidates) != 1 {
+			t.Fatalf("%s: got %d candidates, want 1", test.chain, len(candidates))
+		}
+		if cand := candidates[0]; cand.Transaction != test.txid || cand.Block != test.height || cand.BlockHash != test.block || strings.Join(cand.Rules, ",") != "htlc" {
+			t.Errorf("%s: got candidate %+v", test.chain, cand)
+		}
+		
+		var methods []string
+		for _, req := range node.requests {
+			methods = append(methods, strings.Fields(req)[0])
+		}
+		if got, want := strings.Join(methods, ","), strings.Join(test.requests, ","); got != want {
+			t.Errorf("%s: requests %s, want %s (%q)", test.chain, got, want, node.requests)
+		}
+	}
+}
+
+func TestMWEBBlockFallback(t *testing.T) {
+	c := useRules(t, "LTC")
+	
+	// the block is in the serialization of litecoin core 0.21: the last transaction is the HogEx with the MWEB flag
+	// and an empty MWEB transaction, the MWEB block follows it
+	const hash = "a6db0e89abe78e2ebed5b3638c132de342f832a1dabccf5e3ac17b31c9394a4f"
+	raw := readFixture(t, "ltc_mweb_block.hex")
+	if _, err := decodeBlock(c.Wire, raw); err == nil {
+		t.Fatal("block with MWEB data decoded")
+	}
+	
+	node := newNodeServer(t, "rpc_ltc.json")
+	rawBlock, err := json.Marshal(hex.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.responses[`getblock ["` + hash + `",0]`] = rawBlock
+	
+	src, err := newRPCSource(&rpcclient.ConnConfig{
+		HTTPPostMode: true,
+		DisableTLS: true,
+		Host: strings.TrimPrefix(node.URL, "http://"),
+		User: "user",
+		Pass: "pass",
+	}, false, 1, 0, "rpc", c.Wire, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.c.Shutdown()
+	defer src.batch.Shutdown()
+	
+	// the block is requested as json with the spent outputs instead
+	b, err := src.Block(context.Background(), mustHash(t, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Hash != hash || b.Height != 2600001 || b.Size != int32(len(raw)) || len(b.Tx) != 3 {
+		t.Errorf("got block %s at height %d with %d bytes and %d transactions", b.Hash, b.Height, b.Size, len(b.Tx))
+	}
+	
+	candidates, err := findHTLCs(context.Background(), src, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].Transaction != "00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e" || candidates[0].InputValue != 0.001 {
+		t.Errorf("got candidates %+v", candidates)
+	}
+	
+	if want := []string{`getblock ["` + hash + `",0]`, `getblock ["` + hash + `",3]`}; strings.Join(node.requests, ",") != strings.Join(want, ",") {
+		t.Errorf("got requests %q, want %q", node.requests, want)
+	}
+}
+
+func TestRPCSourceTransactions(t *testing.T) {
+	node := newNodeServer(t, "rpc_btc.json")
+	
+	src, err := newRPCSource(&rpcclient.ConnConfig{
+		HTTPPostMode: true,
+		DisableTLS: true,
+		Host: strings.TrimPrefix(node.URL, "http://"),
+		User: "user",
+		Pass: "pass",
+	}, false, 1, 0, "", "bitcoin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.c.Shutdown()
+	defer src.batch.Shutdown()
+	
+	// the serialized HTLC has a byte after it and is requested as json, the last transaction is not in the mempool
+	txids := make([]*chainhash.Hash, 3)
+	for i, txid := range []string{
+		"556719980fcc9f32ce659177c47e567bc99d6f3f28a78a45f49a7e12a1f3a159",
+		"00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e",
+		strings.Repeat("ab", 32),
+	} {
+		if txids[i], err = chainhash.NewHashFromStr(txid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	txs, err := fetchTransactions(context.Background(), newCachedSource(src, 10, 6), txids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if len(txs) != 3 || txs[0] == nil || txs[1] == nil || txs[2] != nil {
+		t.Fatalf("got transactions %+v", txs)
+	}
+	for i, tx := range txs[:2] {
+		if tx.Txid != txids[i].String() {
+			t.Errorf("%d: got txid %s, want %s", i, tx.Txid, txids[i])
+		}
+	}
+	if !txs[0].Vin[0].Coinbase || txs[1].VSize != 138 || len(txs[1].Vin[0].Witness) != 4 || txs[1].Vout[0].Value != 99000 {
+		t.Errorf("got transactions %+v and %+v", txs[0], txs[1])
+	}
+	
+	// the serialized transactions are requested in one batch
+	if want := []string{
+		`getrawtransaction ["556719980fcc9f32ce659177c47e567bc99d6f3f28a78a45f49a7e12a1f3a159"]`,
+		`getrawtransaction ["00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e"]`,
+		`getrawtransaction ["` + strings.Repeat("ab", 32) + `"]`,
+		`getrawtransaction ["00889dba1f4e8941ada41f7b1c467f688f54619a28d7d97e18e630395338ff6e",1]`,
+	}; strings.Join(node.requests, "\n") != strings.Join(want, "\n") || node.posts != 2 {
+		t.Errorf("got %d http requests %q", node.posts, node.requests)
+	}
+}
+
+func TestRawBlockRetries(t *testing.T) {
+	tip, notes := readZMQFixture(t)
+	raw, err := hex.DecodeString(notes[2].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawBlock, err := json.Marshal(notes[2].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	for _, via := range []string{"rpc", "rest"} {
+		node := newNodeServer(t, "")
+		node.failures = 2
+		node.responses[`getblock ["` + tip.Hash + `",0]`] = rawBlock
+		node.responses[`getblockheader ["` + tip.Hash + `",true]`] = json.RawMessage(`{"hash":"` + tip.Hash + `","height":800001}`)
+		node.rest = map[string][]byte{"/rest/block/" + tip.Hash + ".bin": raw}
+		
+		src, err := newRPCSource(&rpcclient.ConnConfig{
+			HTTPPostMode: true,
+			DisableTLS: true,
+			Host: strings.TrimPrefix(node.URL, "http://"),
+			User: "user",
+			Pass: "pass",
+		}, false, 1, 2, via, "bitcoin", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.delay = time.Millisecond
+		
+		// the serialized block is fetched on the third try, then its height is requested
+		b, err := src.rawBlock(context.Background(), mustHash(t, tip.Hash))
+		src.c.Shutdown()
+		src.batch.Shutdown()
+		if err != nil {
+			t.Fatalf("%s: %v", via, err)
+		}
+		if b.Hash != tip.Hash || b.Height != 800001 || len(b.Tx) != len(tip.Tx) {
+			t.Errorf("%s: got block %s at height %d with %d transactions", via, b.Hash, b.Height, len(b.Tx))
+		}
+		if node.posts != 4 {
+			t.Errorf("%s: got %d http requests, want 4", via, node.posts)
+		}
+	}
+}
+
+func TestRPCSourceContext(t *testing.T) {
+	// the node does not answer until the request is given up
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		http.Error(w, "Work queue depth exceeded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer close(release)
+	
+	src, err := newRPCSource(&rpcclient.ConnConfig{
+		HTTPPostMode: true,
+		DisableTLS: true,
+		Host: strings.TrimPrefix(server.URL, "http://"),
+		User: "user",
+		Pass: "pass",
+	}, false, 1, 3, "rpc", "bitcoin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.c.Shutdown()
+	defer src.batch.Shutdown()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	
+	if _, err := src.BestHeight(ctx); err != context.DeadlineExceeded {
+		t.Errorf("BestHeight: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the serialized block and the json are not retried after the deadline
+	start := time.Now()
+	if _, err := src.Block(ctx, mustHash(t, strings.Repeat("ab", 32))); err != context.DeadlineExceeded {
+		t.Errorf("Block: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Block returned after %v", d)
+	}
+}
@@ -4,127 +4,177 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"runtime/debug"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
+	"github.com/btcsuite/btcd/txscript"
+)
 
-	"github.com/echa/btcutil/log"
-	"github.com/echa/btcutil/txscript"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+var (
+	log        = logging.New("HTLC")
+	flags      = flag.NewFlagSet("preprocess", flag.ContinueOnError)
+	chainsFile string
 )
 
+// opcodeNames are the names of the opcodes without the aliases OP_FALSE, OP_TRUE, OP_NOP2 and OP_NOP3
+var opcodeNames = make(map[byte]string)
+
+func init() {
+	for name, op := range txscript.OpcodeByName {
+		switch name {
+		case "OP_FALSE", "OP_TRUE", "OP_NOP2", "OP_NOP3":
+			continue
+		}
+		opcodeNames[op] = name
+	}
+	
+	flags.Usage = func() {}
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
+}
+
 type candidate struct {
 	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
 	Timestamp   string   `json:"timestamp"`
 	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
 	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
 	InputValue  float64  `json:"input_value"`
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	PrevScript  string   `json:"prev_script"`
 	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	Family      string   `json:"family"`
+	Refund      bool     `json:"refund,omitempty"`
+	Funding     string   `json:"funding,omitempty"`
+	Lightning   string   `json:"lightning,omitempty"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
 }
 
 type processedCandidate struct {
 	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
 	Timestamp   string   `json:"timestamp"`
 	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
 	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
 	InputValue  float64  `json:"input_value"`
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	PrevScript  string   `json:"prev_script"`
 	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	Family      string   `json:"family"`
+	Refund      bool     `json:"refund,omitempty"`
+	Funding     string   `json:"funding,omitempty"`
+	Lightning   string   `json:"lightning,omitempty"`
+	// the transaction is also in the candidates of the parent or a forked chain
+	Replayed    bool     `json:"replayed,omitempty"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
 	Ops         []string `json:"ops"`
 }
 
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
 	
-	// for all blockchains
-	for i := 0; i < 4; i++ {
-		
-		var thisPCs []processedCandidate
-		jsonFileName1 := ""
-		jsonFileName2 := ""
-		
-		// set some stuff
-		switch i {
-			case 0:
-				jsonFileName1 = "HTLCsBTC.json"
-				jsonFileName2 = "pHTLCsBTC.json"
-			case 1:
-				jsonFileName1 = "HTLCsLTC.json"
-				jsonFileName2 = "pHTLCsLTC.json"
-			case 2:
-				jsonFileName1 = "HTLCsBCH.json"
-				jsonFileName2 = "pHTLCsBCH.json"
-			case 3:
-				jsonFileName1 = "HTLCsDCR.json"
-				jsonFileName2 = "pHTLCsDCR.json"
+	// parse command line flags
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Println("HTLC Preprocessing")
+			flags.PrintDefaults()
+			os.Exit(0)
 		}
+		log.Fatalf("Error: %v", err)
+	}
+	
+	// for all blockchains in the registry
+	chains, err := registry.Read(chainsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	// read the candidates of all chains, forked chains need the ones of their parent
+	allHTLCs := make(map[string][]candidate)
+	
+	for _, c := range chains {
+		jsonFileName1 := c.File("candidates")
 		
 		// read candidates from file
-		raw, err := ioutil.ReadFile(jsonFileName1)
+		thisHTLCs, err := readCandidates(jsonFileName1)
+		if os.IsNotExist(err) {
+			log.Infof("skipping %s, %s does not exist", c.Name, jsonFileName1)
+			continue
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		
-		// create candidates slice
-		var thisHTLCs []candidate
+		allHTLCs[c.Name] = thisHTLCs
+	}
+	
+	// the shared history of forked chains belongs to the parent
+	replayed, err := attributeForks(chains, allHTLCs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	for _, c := range chains {
+		
+		var thisPCs []processedCandidate
+		jsonFileName2 := c.File("processed")
 		
-		// unmarshal json into candidates slice
-		err = json.Unmarshal(raw, &thisHTLCs)
-		if err != nil {
-			log.Fatal(err)
+		thisHTLCs, ok := allHTLCs[c.Name]
+		if !ok {
+			continue
 		}
 		
 		// iterate over all found possible HTLCs
 		for _, thisHTLC := range(thisHTLCs) {
 			
-			var ops []string
-			
-			// extract the asm
-			asm := thisHTLC.Asm
-			length := len(asm)
-			
-			script, err := hex.DecodeString(asm[length - 1])
-			
-			pops, err := txscript.ParseScript(script)
+			thisPC, err := preprocess(thisHTLC, replayed[c.Name][thisHTLC.Transaction])
 			if err != nil {
 				log.Fatal(err)
 			}
 			
-			for _, op := range pops {
-				if op.Opcode != nil {
-					if len(op.Data) > 0 {
-						ops = append(ops, op.Opcode.Name + " " + hex.EncodeToString(op.Data))
-					} else {
-						ops = append(ops, op.Opcode.Name)
-					}
-				}
-			}
-			
-			thisPC := new(processedCandidate)
-			
-			// add the ops string to the candidate
-			*thisPC = processedCandidate {
-				Block: thisHTLC.Block,
-				Timestamp: thisHTLC.Timestamp,
-				Transaction: thisHTLC.Transaction,
-				InputTx: thisHTLC.InputTx,
-				InputValue: thisHTLC.InputValue,
-				Asm: thisHTLC.Asm,
-				Ops: ops,
-			}
-			
 			// add this candidate to the slice
-			thisPCs = append(thisPCs, *thisPC)
+			thisPCs = append(thisPCs, thisPC)
 		}
 		
 		// format json
@@ -141,4 +191,169 @@ func main() {
 	}
 	
 	log.Infof("All done.")
-}
\ No newline at end of file
+}
+
+// preprocess adds the opcodes of the script to a candidate
+func preprocess(c candidate, replayed bool) (processedCandidate, error) {
+	var ops []string
+	
+	// extract the asm, its last element is the script
+	// (for bare HTLCs it is the script of the spent output, which was appended by the detection)
+	asm := c.Asm
+	length := len(asm)
+	
+	script, err := hex.DecodeString(asm[length - 1])
+	if err != nil {
+		return processedCandidate{}, err
+	}
+	
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	for tokenizer.Next() {
+		name := opcodeNames[tokenizer.Opcode()]
+		// tapscript turned OP_UNKNOWN186 into OP_CHECKSIGADD
+		if c.SpendType != "p2tr" && tokenizer.Opcode() == txscript.OP_CHECKSIGADD {
+			name = "OP_UNKNOWN186"
+		}
+		
+		if data := tokenizer.Data(); len(data) > 0 {
+			ops = append(ops, name + " " + hex.EncodeToString(data))
+		} else {
+			ops = append(ops, name)
+		}
+	}
+	if err := tokenizer.Err(); err != nil {
+		return processedCandidate{}, err
+	}
+	
+	// files written before witnesses were inspected only contain p2sh spends
+	spendType := c.SpendType
+	if spendType == "" {
+		spendType = "p2sh"
+	}
+	
+	// and no other family than htlc
+	family := c.Family
+	if family == "" {
+		family = "htlc"
+	}
+	
+	// add the ops string to the candidate
+	return processedCandidate {
+		Block: c.Block,
+		BlockHash: c.BlockHash,
+		Timestamp: c.Timestamp,
+		Transaction: c.Transaction,
+		Version: c.Version,
+		LockTime: c.LockTime,
+		Fee: c.Fee,
+		VSize: c.VSize,
+		Expiry: c.Expiry,
+		Tree: c.Tree,
+		InputIndex: c.InputIndex,
+		Sequence: c.Sequence,
+		InputTx: c.InputTx,
+		InputVout: c.InputVout,
+		InputValue: c.InputValue,
+		Asset: c.Asset,
+		Blinded: c.Blinded,
+		PrevScript: c.PrevScript,
+		Asm: c.Asm,
+		SpendType: spendType,
+		Family: family,
+		Refund: c.Refund,
+		Funding: c.Funding,
+		Lightning: c.Lightning,
+		Replayed: replayed,
+		LeafVersion: c.LeafVersion,
+		InternalKey: c.InternalKey,
+		MerklePath: c.MerklePath,
+		Ops: ops,
+	}, nil
+}
+
+// attributeForks drops the candidates of forked chains below the fork, which belong to the parent, and
+// returns the transactions found on a forked chain and on its parent after the fork, by chain
+func attributeForks(chains []*registry.Chain, allHTLCs map[string][]candidate) (map[string]map[string]bool, error) {
+	replayed := make(map[string]map[string]bool)
+	
+	for _, c := range chains {
+		if c.Fork == nil {
+			continue
+		}
+		
+		parent := registry.Find(chains, c.Fork.Parent)
+		if parent == nil {
+			return nil, fmt.Errorf("parent %s of %s is not in the chain registry", c.Fork.Parent, c.Name)
+		}
+		
+		thisHTLCs, ok := allHTLCs[c.Name]
+		if !ok {
+			continue
+		}
+		
+		// the shared history is attributed to the parent
+		var ownHTLCs []candidate
+		for _, thisHTLC := range thisHTLCs {
+			if thisHTLC.Block >= c.Fork.Height {
+				ownHTLCs = append(ownHTLCs, thisHTLC)
+			}
+		}
+		if dropped := len(thisHTLCs) - len(ownHTLCs); dropped > 0 {
+			log.Infof("dropping %d candidates of %s below block %d, they belong to %s", dropped, c.Name, c.Fork.Height, parent.Name)
+		}
+		allHTLCs[c.Name] = ownHTLCs
+		
+		// transactions valid on both chains are replayed after the fork
+		txs := make(map[string]bool)
+		for _, thisHTLC := range ownHTLCs {
+			txs[thisHTLC.Transaction] = true
+		}
+		for _, thisHTLC := range allHTLCs[parent.Name] {
+			if txs[thisHTLC.Transaction] {
+				for _, name := range []string{c.Name, parent.Name} {
+					if replayed[name] == nil {
+						replayed[name] = make(map[string]bool)
+					}
+					replayed[name][thisHTLC.Transaction] = true
+				}
+			}
+		}
+	}
+	
+	return replayed, nil
+}
+
+// readCandidates reads the output of stage 1, which is one candidate per line.
+// An incomplete last line of an interrupted scan is ignored. Older versions wrote a json array.
+func readCandidates(fileName string) ([]candidate, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	
+	var candidates []candidate
+	
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(raw, &candidates)
+		return candidates, err
+	}
+	
+	for len(raw) > 0 {
+		end := bytes.IndexByte(raw, '\n')
+		if end < 0 {
+			log.Infof("ignoring incomplete last line of %s", fileName)
+			break
+		}
+		
+		var c candidate
+		if err := json.Unmarshal(raw[:end], &c); err != nil {
+			log.Infof("ignoring %s after an invalid line: %v", fileName, err)
+			break
+		}
+		
+		candidates = append(candidates, c)
+		raw = raw[end + 1:]
+	}
+	
+	return candidates, nil
+}
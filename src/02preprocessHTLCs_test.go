@@ -0,0 +1,182 @@
+// Copyright (c) 2018 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+// The tests of the preprocessing are run with
+// go test 02preprocessHTLCs.go 02preprocessHTLCs_test.go
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	
+	"detect-atomic-swaps/registry"
+)
+
+func TestAttributeForks(t *testing.T) {
+	chains := []*registry.Chain{
+		{Name: "BTC"},
+		{Name: "BCH", Fork: &registry.Fork{Parent: "BTC", Height: 478559}},
+		{Name: "BSV", Fork: &registry.Fork{Parent: "BCH", Height: 556767}},
+	}
+	
+	// BCH candidates written by scans before the fork was known, one of them replayed on BTC after the fork,
+	// there are no candidates of BSV
+	allHTLCs := map[string][]candidate{
+		"BTC": {
+			{Block: 400000, Transaction: "aa"},
+			{Block: 478600, Transaction: "bb"},
+		},
+		"BCH": {
+			{Block: 400000, Transaction: "aa"},
+			{Block: 478558, Transaction: "cc"},
+			{Block: 478559, Transaction: "dd"},
+			{Block: 478600, Transaction: "bb"},
+		},
+	}
+	
+	replayed, err := attributeForks(chains, allHTLCs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if got := allHTLCs["BTC"]; len(got) != 2 {
+		t.Errorf("got %d candidates of BTC, want 2", len(got))
+	}
+	if got := allHTLCs["BCH"]; len(got) != 2 || got[0].Transaction != "dd" || got[1].Transaction != "bb" {
+		t.Errorf("got candidates %+v of BCH, want dd and bb", got)
+	}
+	if _, ok := allHTLCs["BSV"]; ok {
+		t.Errorf("BSV has no candidates but got an entry")
+	}
+	
+	tests := []struct {
+		chain string
+		tx    string
+		want  bool
+	}{
+		{"BTC", "aa", false},
+		{"BTC", "bb", true},
+		{"BCH", "bb", true},
+		{"BCH", "dd", false},
+		{"BSV", "bb", false},
+	}
+	for _, test := range tests {
+		if got := replayed[test.chain][test.tx]; got != test.want {
+			t.Errorf("%s %s: replayed is %v, want %v", test.chain, test.tx, got, test.want)
+		}
+	}
+}
+
+func TestAttributeForksUnknownParent(t *testing.T) {
+	chains := []*registry.Chain{
+		{Name: "BCH", Fork: &registry.Fork{Parent: "BTC", Height: 478559}},
+	}
+	allHTLCs := map[string][]candidate{
+		"BCH": {{Block: 478600, Transaction: "bb"}},
+	}
+	
+	if _, err := attributeForks(chains, allHTLCs); err == nil {
+		t.Errorf("fork of a chain which is not in the registry is accepted")
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	hash := strings.Repeat("11", 32)
+	key1 := strings.Repeat("22", 20)
+	key2 := strings.Repeat("33", 20)
+	script := "63a820" + hash + "8876a914" + key1 + "6703a08601b17576a914" + key2 + "6888ac"
+	
+	fee := 0.0002
+	c := candidate{
+		Block: 700000,
+		BlockHash: strings.Repeat("0b", 32),
+		Timestamp: "2021-09-07 07:00:00",
+		Transaction: "aa",
+		Version: 2,
+		LockTime: 699990,
+		Fee: &fee,
+		VSize: 237,
+		InputIndex: 1,
+		Sequence: 0xfffffffd,
+		InputTx: "bb",
+		InputVout: 7,
+		InputValue: 0.001,
+		PrevScript: "0020" + strings.Repeat("44", 32),
+		Asm: []string{"3045", "02", hash, "1", script},
+		SpendType: "p2wsh",
+		Funding: "cc",
+	}
+	
+	pc, err := preprocess(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	want := processedCandidate{
+		Block: 700000,
+		BlockHash: c.BlockHash,
+		Timestamp: c.Timestamp,
+		Transaction: "aa",
+		Version: 2,
+		LockTime: 699990,
+		Fee: &fee,
+		VSize: 237,
+		InputIndex: 1,
+		Sequence: 0xfffffffd,
+		InputTx: "bb",
+		InputVout: 7,
+		InputValue: 0.001,
+		PrevScript: c.PrevScript,
+		Asm: c.Asm,
+		SpendType: "p2wsh",
+		Family: "htlc",
+		Funding: "cc",
+		Replayed: true,
+		Ops: []string{
+			"OP_IF", "OP_SHA256", "OP_DATA_32 " + hash, "OP_EQUALVERIFY", "OP_DUP", "OP_HASH160", "OP_DATA_20 " + key1,
+			"OP_ELSE", "OP_DATA_3 a08601", "OP_CHECKLOCKTIMEVERIFY", "OP_DROP", "OP_DUP", "OP_HASH160", "OP_DATA_20 " + key2,
+			"OP_ENDIF", "OP_EQUALVERIFY", "OP_CHECKSIG",
+		},
+	}
+	if !reflect.DeepEqual(pc, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", pc, want)
+	}
+}
+
+func TestPreprocessOps(t *testing.T) {
+	tests := []struct {
+		script    string
+		spendType string
+		ops       []string
+	}{
+		// files written before witnesses were inspected
+		{"00516093", "", []string{"OP_0", "OP_1", "OP_16", "OP_ADD"}},
+		{"4c0102", "p2sh", []string{"OP_PUSHDATA1 02"}},
+		{"ba", "p2wsh", []string{"OP_UNKNOWN186"}},
+		{"ba", "p2tr", []string{"OP_CHECKSIGADD"}},
+		{"b1b2", "p2sh", []string{"OP_CHECKLOCKTIMEVERIFY", "OP_CHECKSEQUENCEVERIFY"}},
+	}
+	
+	for _, test := range tests {
+		pc, err := preprocess(candidate{Asm: []string{test.script}, SpendType: test.spendType}, false)
+		if err != nil {
+			t.Errorf("%s: %v", test.script, err)
+			continue
+		}
+		if !reflect.DeepEqual(pc.Ops, test.ops) {
+			t.Errorf("%s: got ops %v, want %v", test.script, pc.Ops, test.ops)
+		}
+		if test.spendType == "" && pc.SpendType != "p2sh" {
+			t.Errorf("%s: got spend type %q, want p2sh", test.script, pc.SpendType)
+		}
+	}
+	
+	// scripts which are not hex or end in the middle of a push
+	for _, script := range []string{"zz", "4c05aa"} {
+		if _, err := preprocess(candidate{Asm: []string{script}}, false); err == nil {
+			t.Errorf("%s: the script is accepted", script)
+		}
+	}
+}
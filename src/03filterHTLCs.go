@@ -5,61 +5,100 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"runtime/debug"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
+)
 
-	"github.com/echa/btcutil/log"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+var (
+	log        = logging.New("HTLC")
+	flags      = flag.NewFlagSet("filter", flag.ContinueOnError)
+	chainsFile string
 )
 
+func init() {
+	flags.Usage = func() {}
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
+}
+
 type processedCandidate struct {
 	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
 	Timestamp   string   `json:"timestamp"`
 	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
 	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
 	InputValue  float64  `json:"input_value"`
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	PrevScript  string   `json:"prev_script"`
 	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	Family      string   `json:"family"`
+	Refund      bool     `json:"refund,omitempty"`
+	Funding     string   `json:"funding,omitempty"`
+	Lightning   string   `json:"lightning,omitempty"`
+	Replayed    bool     `json:"replayed,omitempty"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
 	Ops         []string `json:"ops"`
 }
 
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
 	
-	// for all blockchains
-	for i := 0; i < 4; i++ {
+	// parse command line flags
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Println("HTLC Filter")
+			flags.PrintDefaults()
+			os.Exit(0)
+		}
+		log.Fatalf("Error: %v", err)
+	}
+	
+	// for all blockchains in the registry
+	chains, err := registry.Read(chainsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	for _, c := range chains {
 		
 		var thisPCs []processedCandidate
-		jsonFileName1 := ""
-		jsonFileName2 := ""
-		
-		// set some stuff
-		switch i {
-			case 0:
-				jsonFileName1 = "pHTLCsBTC.json"
-				jsonFileName2 = "filteredHTLCsBTC.json"
-			case 1:
-				jsonFileName1 = "pHTLCsLTC.json"
-				jsonFileName2 = "filteredHTLCsLTC.json"
-			case 2:
-				jsonFileName1 = "pHTLCsBCH.json"
-				jsonFileName2 = "filteredHTLCsBCH.json"
-			case 3:
-				jsonFileName1 = "pHTLCsDCR.json"
-				jsonFileName2 = "filteredHTLCsDCR.json"
-		}
+		var lightningPCs []processedCandidate
+		jsonFileName1 := c.File("processed")
+		jsonFileName2 := c.File("filtered")
+		lightningFileName := c.File("lightning")
 		
 		// read candidates from file
 		raw, err := ioutil.ReadFile(jsonFileName1)
+		if os.IsNotExist(err) {
+			log.Infof("skipping %s, %s does not exist", c.Name, jsonFileName1)
+			continue
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -76,11 +115,18 @@ func main() {
 		// iterate over all found possible HTLCs
 		for _, thisHTLC := range(thisHTLCs) {
 			
+			// the htlcs of lightning channels are no atomic swaps, they are kept in their own file
+			if thisHTLC.Lightning != "" {
+				lightningPCs = append(lightningPCs, thisHTLC)
+				continue
+			}
+			
 			ops := thisHTLC.Ops
 			
 			foundEqual := false
 			foundIf := false
 			foundSig := false
+			foundTimelock := false
 			
 			for _, op := range(ops) {
 				if op == "OP_EQUAL" || op == "OP_EQUALVERIFY" {
@@ -91,10 +137,24 @@ func main() {
 					foundIf = true
 				}
 				
-				if op == "OP_CHECKSIG" || op == "OP_CHECKSIGVERIFY" {
+				if op == "OP_CHECKSIG" || op == "OP_CHECKSIGVERIFY" || op == "OP_CHECKSIGADD" {
+					foundSig = true
+				}
+				
+				// the refund of hashlock-multisig swaps is signed by both parties
+				if thisHTLC.Family == "hashlock-multisig" && (op == "OP_CHECKMULTISIG" || op == "OP_CHECKMULTISIGVERIFY") {
 					foundSig = true
 				}
 				
+				if op == "OP_CHECKLOCKTIMEVERIFY" || op == "OP_CHECKSEQUENCEVERIFY" {
+					foundTimelock = true
+				}
+				
+			}
+			
+			// a tapscript leaf needs no branches if it has the timelock itself or the timelock may be in a sibling leaf
+			if thisHTLC.SpendType == "p2tr" && (foundTimelock || len(thisHTLC.MerklePath) > 0) {
+				foundIf = true
 			}
 			
 			// if all requirements are found
@@ -115,6 +175,17 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		
+		// and the lightning candidates
+		lightningJson, err := json.MarshalIndent(lightningPCs, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		
+		err = ioutil.WriteFile(lightningFileName, lightningJson, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	
 	log.Infof("All done.")
@@ -9,21 +9,20 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
-
-	"github.com/echa/btcutil/log"
-	"github.com/echa/btcutil/rpc"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
 )
 
 var (
-	jrpcLog     = log.NewLogger("JRPC")
+	log         = logging.New("HTLC")
 	flags       = flag.NewFlagSet("index", flag.ContinueOnError)
 	height      int64
 	chain       string
@@ -33,28 +32,51 @@ var (
 	pass        string
 	verbose     bool
 	concurrency int
+	chainsFile  string
 )
 
 func init() {
 	flags.Usage = func() {}
 	flags.Int64Var(&height, "height", 0, "start height")
 	flags.StringVar(&chain, "chain", "bitcoin", "blockchain")
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
 	flags.StringVar(&host, "host", "127.0.0.1", "RPC hostname")
 	flags.StringVar(&user, "user", "", "RPC username")
 	flags.StringVar(&pass, "pass", "", "RPC password")
 	flags.StringVar(&port, "port", "", "RPC port")
 	flags.IntVar(&concurrency, "c", 1, "RPC Concurrency")
 	flags.BoolVar(&verbose, "v", false, "be verbose")
-	rpc.UseLogger(jrpcLog)
 }
 
 type processedCandidate struct {
 	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
 	Timestamp   string   `json:"timestamp"`
 	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
 	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
 	InputValue  float64  `json:"input_value"`
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	PrevScript  string   `json:"prev_script"`
 	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	Family      string   `json:"family"`
+	Refund      bool     `json:"refund,omitempty"`
+	Funding     string   `json:"funding,omitempty"`
+	Lightning   string   `json:"lightning,omitempty"`
+	Replayed    bool     `json:"replayed,omitempty"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
 	Ops         []string `json:"ops"`
 }
 
@@ -65,7 +87,7 @@ type htlcType struct {
 
 // detect of which type a PC is
 // if a new type was found save it
-func registerType(PC processedCandidate, types []htlcType, chain string) ([]htlcType) {
+func registerType(PC processedCandidate, types []htlcType, c *registry.Chain) ([]htlcType) {
 	length := len(PC.Ops)
 	typeFound := false
 	
@@ -87,16 +109,9 @@ func registerType(PC processedCandidate, types []htlcType, chain string) ([]htlc
 			PC.Ops[i] = "OP_"
 		}
 		
-		// if it is a dcr htlc
-		if chain == "dcr" {
-			// dcr replaced OP_SHA256 with OP_BLAKE256
-			if op == "OP_SHA256" {
-				PC.Ops[i] = "OP_BLAKE256"
-			}
-			// and moved OP_SHA256 to OP_UNKNOWN192
-			if op == "OP_UNKNOWN192" {
-				PC.Ops[i] = "OP_SHA256"
-			}
+		// opcodes with a different meaning on this chain (e.g. dcr replaced OP_SHA256 with OP_BLAKE256)
+		if name, ok := c.Opcodes[op]; ok {
+			PC.Ops[i] = name
 		}
 	}
 	
@@ -153,13 +168,23 @@ func registerType(PC processedCandidate, types []htlcType, chain string) ([]htlc
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
 	
+	// parse command line flags
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Println("HTLC Type Registration")
+			flags.PrintDefaults()
+			os.Exit(0)
+		}
+		log.Fatalf("Error: %v", err)
+	}
+	
 	// read types from file
 	raw, err := ioutil.ReadFile("types.json")
 	if err != nil {
@@ -167,38 +192,30 @@ func main() {
 	}
 	
 	var types []htlcType
-
+	
 	// unmarshal json into types slice
 	err = json.Unmarshal(raw, &types)
 	if err != nil {
 		log.Fatal(err)
 	}
 	
-	// for all blockchains
-	for i := 0; i < 4; i++ {
+	// for all blockchains in the registry
+	chains, err := registry.Read(chainsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	for _, c := range chains {
 		
 		var thisPCs []processedCandidate
-		jsonFileName := ""
-		chain := ""
-		
-		// set some stuff
-		switch i {
-			case 0:
-				jsonFileName = "filteredHTLCsBTC.json"
-				chain = "btc"
-			case 1:
-				jsonFileName = "filteredHTLCsLTC.json"
-				chain = "ltc"
-			case 2:
-				jsonFileName = "filteredHTLCsBCH.json"
-				chain = "bch"
-			case 3:
-				jsonFileName = "filteredHTLCsDCR.json"
-				chain = "dcr"
-		}
+		jsonFileName := c.File("filtered")
 		
 		// read candidates from file
 		raw, err := ioutil.ReadFile(jsonFileName)
+		if os.IsNotExist(err) {
+			log.Infof("skipping %s, %s does not exist", c.Name, jsonFileName)
+			continue
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -212,7 +229,7 @@ func main() {
 		// iterate over all found possible HTLCs
 		for _, thisPC := range(thisPCs) {
 			
-			types = registerType(thisPC, types, chain)
+			types = registerType(thisPC, types, c)
 			
 		}
 	}
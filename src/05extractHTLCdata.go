@@ -13,20 +13,18 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"runtime/debug"
 	"strings"
 //	"golang.org/x/crypto/ripemd160"
-
-	"github.com/echa/btcutil/log"
-	"github.com/echa/btcutil/rpc"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
 )
 
 var (
-	jrpcLog     = log.NewLogger("JRPC")
+	log         = logging.New("HTLC")
 	flags       = flag.NewFlagSet("index", flag.ContinueOnError)
 	height      int64
 	chain       string
@@ -36,38 +34,83 @@ var (
 	pass        string
 	verbose     bool
 	concurrency int
+	chainsFile  string
 )
 
 func init() {
 	flags.Usage = func() {}
 	flags.Int64Var(&height, "height", 0, "start height")
 	flags.StringVar(&chain, "chain", "bitcoin", "blockchain")
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
 	flags.StringVar(&host, "host", "127.0.0.1", "RPC hostname")
 	flags.StringVar(&user, "user", "", "RPC username")
 	flags.StringVar(&pass, "pass", "", "RPC password")
 	flags.StringVar(&port, "port", "", "RPC port")
 	flags.IntVar(&concurrency, "c", 1, "RPC Concurrency")
 	flags.BoolVar(&verbose, "v", false, "be verbose")
-	rpc.UseLogger(jrpcLog)
 }
 
 type processedCandidate struct {
 	Block       int64    `json:"block"`
+	BlockHash   string   `json:"block_hash"`
 	Timestamp   string   `json:"timestamp"`
 	Transaction string   `json:"transaction"`
+	Version     int32    `json:"version"`
+	LockTime    uint32   `json:"lock_time"`
+	Fee         *float64 `json:"fee,omitempty"`
+	VSize       int64    `json:"vsize"`
+	Expiry      uint32   `json:"expiry,omitempty"`
+	Tree        int8     `json:"tree,omitempty"`
+	InputIndex  int      `json:"input_index"`
+	Sequence    uint32   `json:"sequence"`
 	InputTx     string   `json:"input_tx"`
+	InputVout   uint32   `json:"input_vout"`
 	InputValue  float64  `json:"input_value"`
+	Asset       string   `json:"asset,omitempty"`
+	Blinded     bool     `json:"blinded,omitempty"`
+	PrevScript  string   `json:"prev_script"`
 	Asm         []string `json:"asm"`
+	SpendType   string   `json:"spend_type"`
+	Family      string   `json:"family"`
+	Refund      bool     `json:"refund,omitempty"`
+	Funding     string   `json:"funding,omitempty"`
+	Lightning   string   `json:"lightning,omitempty"`
+	Replayed    bool     `json:"replayed,omitempty"`
+	LeafVersion int      `json:"leaf_version,omitempty"`
+	InternalKey string   `json:"internal_key,omitempty"`
+	MerklePath  []string `json:"merkle_path,omitempty"`
 	Ops         []string `json:"ops"`
 }
 
 type htlc struct {
 	Chain        string   `json:"chain"`
 	Block        int64    `json:"block"`
+	BlockHash    string   `json:"block_hash"`
 	Timestamp    string   `json:"timestamp"`
 	Transaction  string   `json:"transaction"`
+	Version      int32    `json:"version"`
+	LockTime     uint32   `json:"lock_time"`
+	Fee          *float64 `json:"fee,omitempty"`
+	VSize        int64    `json:"vsize"`
+	Expiry       uint32   `json:"expiry,omitempty"`
+	Tree         int8     `json:"tree,omitempty"`
+	InputIndex   int      `json:"input_index"`
+	Sequence     uint32   `json:"sequence"`
 	InputTx      string   `json:"input_tx"`
+	InputVout    uint32   `json:"input_vout"`
 	InputValue   float64  `json:"input_value"`
+	Asset        string   `json:"asset,omitempty"`
+	Blinded      bool     `json:"blinded,omitempty"`
+	PrevScript   string   `json:"prev_script"`
+	SpendType    string   `json:"spend_type"`
+	Family       string   `json:"family"`
+	Refund       bool     `json:"refund,omitempty"`
+	Funding      string   `json:"funding,omitempty"`
+	// the transaction is also in the HTLCs of the parent or a forked chain
+	Replayed     bool     `json:"replayed,omitempty"`
+	LeafVersion  int      `json:"leaf_version,omitempty"`
+	InternalKey  string   `json:"internal_key,omitempty"`
+	MerklePath   []string `json:"merkle_path,omitempty"`
 	Type         string   `json:"type"`
 	Timelock     string   `json:"timelock"`
 	PubKeys1     []string `json:"pub_key_hashes1"`
@@ -89,22 +132,16 @@ type filteredHTLCType struct {
 
 // detect of which type a PC is
 // if a new type was found save it
-func extractData(PC processedCandidate, types []filteredHTLCType, chain string) (*htlc, error) {
+func extractData(PC processedCandidate, types []filteredHTLCType, c *registry.Chain) (*htlc, error) {
 	length := len(PC.Ops)
 	typeFound := false
 	matchingType := ""
 	matchingTypeNumber := -1
 	
-	if chain == "dcr" {
-		for i, op := range(PC.Ops) {
-			// dcr replaced OP_SHA256 with OP_BLAKE256
-			if op == "OP_SHA256" {
-				PC.Ops[i] = "OP_BLAKE256"
-			}
-			// and moved OP_SHA256 to OP_UNKNOWN192
-			if op == "OP_UNKNOWN192" {
-				PC.Ops[i] = "OP_SHA256"
-			}
+	// opcodes with a different meaning on this chain (e.g. dcr replaced OP_SHA256 with OP_BLAKE256)
+	for i, op := range(PC.Ops) {
+		if name, ok := c.Opcodes[op]; ok {
+			PC.Ops[i] = name
 		}
 	}
 	
@@ -161,14 +198,17 @@ func extractData(PC processedCandidate, types []filteredHTLCType, chain string)
 	thisType = types[matchingTypeNumber]
 	index := 0
 	
-	// get the timelock
-	thisOp := PC.Ops[thisType.LocktimePos]
+	// get the timelock (a negative position means the type has none, like the hashlock leaf of a tapscript HTLC)
+	thisOp := ""
 	timelock := ""
-	if strings.Contains(thisOp, " ") {
-		index = strings.Index(thisOp, " ") + 1
-		timelock = thisOp[index:]
-	} else {
-		timelock = thisOp[3:]
+	if thisType.LocktimePos >= 0 {
+		thisOp = PC.Ops[thisType.LocktimePos]
+		if strings.Contains(thisOp, " ") {
+			index = strings.Index(thisOp, " ") + 1
+			timelock = thisOp[index:]
+		} else {
+			timelock = thisOp[3:]
+		}
 	}
 	
 	
@@ -181,9 +221,12 @@ func extractData(PC processedCandidate, types []filteredHTLCType, chain string)
 	}
 	
 	// get the public key 2
-	thisOp = PC.Ops[thisType.PublicKey2Pos]
-	index = strings.Index(thisOp, " ") + 1
-	pubKey2 := thisOp[index:]
+	pubKey2 := ""
+	if thisType.PublicKey2Pos >= 0 {
+		thisOp = PC.Ops[thisType.PublicKey2Pos]
+		index = strings.Index(thisOp, " ") + 1
+		pubKey2 = thisOp[index:]
+	}
 	
 	secretHashes := []string{}
 	// get the secret hashes
@@ -400,6 +443,11 @@ func extractData(PC processedCandidate, types []filteredHTLCType, chain string)
 			secrets = append(secrets, "none")
 		}
 //		hashType = 4
+	default:
+		// tapscript leaves have no branches, the secret of a hashlock leaf lies right below the leaf
+		if PC.SpendType == "p2tr" && len(secretHashes) > 0 && asmLength >= 2 {
+			secrets = append(secrets, PC.Asm[asmLength - 2])
+		}
 	}
 	
 //	foundCount := 0
@@ -472,12 +520,33 @@ func extractData(PC processedCandidate, types []filteredHTLCType, chain string)
 	newHTLC := new(htlc)
 	
 	*newHTLC = htlc{
-		Chain: chain,
+		Chain: strings.ToLower(c.Name),
 		Block: PC.Block,
+		BlockHash: PC.BlockHash,
 		Timestamp: PC.Timestamp,
 		Transaction: PC.Transaction,
+		Version: PC.Version,
+		LockTime: PC.LockTime,
+		Fee: PC.Fee,
+		VSize: PC.VSize,
+		Expiry: PC.Expiry,
+		Tree: PC.Tree,
+		InputIndex: PC.InputIndex,
+		Sequence: PC.Sequence,
 		InputTx: PC.InputTx,
+		InputVout: PC.InputVout,
 		InputValue: PC.InputValue,
+		Asset: PC.Asset,
+		Blinded: PC.Blinded,
+		PrevScript: PC.PrevScript,
+		SpendType: PC.SpendType,
+		Family: PC.Family,
+		Refund: PC.Refund,
+		Funding: PC.Funding,
+		Replayed: PC.Replayed,
+		LeafVersion: PC.LeafVersion,
+		InternalKey: PC.InternalKey,
+		MerklePath: PC.MerklePath,
 		Type: matchingType,
 		Timelock: timelock,
 		PubKeys1: pubKeys1,
@@ -494,13 +563,23 @@ func extractData(PC processedCandidate, types []filteredHTLCType, chain string)
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
 	
+	// parse command line flags
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Println("HTLC Data Extraction")
+			flags.PrintDefaults()
+			os.Exit(0)
+		}
+		log.Fatalf("Error: %v", err)
+	}
+	
 	// read types from file
 	raw, err := ioutil.ReadFile("filteredTypes.json")
 	if err != nil {
@@ -508,44 +587,32 @@ func main() {
 	}
 	
 	var types []filteredHTLCType
-
+	
 	// unmarshal json into types slice
 	err = json.Unmarshal(raw, &types)
 	if err != nil {
 		log.Fatal(err)
 	}
 	
-	// for all blockchains
-	for i := 0; i < 4; i++ {
+	// for all blockchains in the registry
+	chains, err := registry.Read(chainsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	for _, c := range chains {
 		
 		var thisPCs []processedCandidate
 		var htlcs []htlc
-		jsonFileName1 := ""
-		jsonFileName2 := ""
-		chain := ""
-		
-		// set some stuff
-		switch i {
-			case 0:
-				jsonFileName1 = "filteredHTLCsBTC.json"
-				jsonFileName2 = "realHTLCsBTC.json"
-				chain = "btc"
-			case 1:
-				jsonFileName1 = "filteredHTLCsLTC.json"
-				jsonFileName2 = "realHTLCsLTC.json"
-				chain = "ltc"
-			case 2:
-				jsonFileName1 = "filteredHTLCsBCH.json"
-				jsonFileName2 = "realHTLCsBCH.json"
-				chain = "bch"
-			case 3:
-				jsonFileName1 = "filteredHTLCsDCR.json"
-				jsonFileName2 = "realHTLCsDCR.json"
-				chain = "dcr"
-		}
+		jsonFileName1 := c.File("filtered")
+		jsonFileName2 := c.File("htlcs")
 		
 		// read candidates from file
 		raw, err := ioutil.ReadFile(jsonFileName1)
+		if os.IsNotExist(err) {
+			log.Infof("skipping %s, %s does not exist", c.Name, jsonFileName1)
+			continue
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -561,7 +628,7 @@ func main() {
 		// iterate over all found possible HTLCs
 		for _, thisPC := range(thisPCs) {
 			
-			newHTLC, err = extractData(thisPC, types, chain)
+			newHTLC, err = extractData(thisPC, types, c)
 			if err != nil {
 //				log.Fatal(err)
 			} else {
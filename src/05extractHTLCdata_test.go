@@ -0,0 +1,123 @@
+// Author: dominik.lauck@mailbox.tu-dresden.de
+// 
+// The tests of the extraction are run with
+// go test 05extractHTLCdata.go 05extractHTLCdata_test.go
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	
+	"detect-atomic-swaps/registry"
+)
+
+// a sha256 HTLC with an absolute locktime
+var type1a = filteredHTLCType{
+	Name: "Type1a",
+	Length: 17,
+	SecrethashPos: []int{2},
+	LocktimePos: 8,
+	PublicKeys1Pos: []int{6},
+	PublicKey2Pos: 13,
+	Ops: []string{
+		"OP_IF", "OP_SHA256", "OP_DATA_32", "OP_EQUALVERIFY", "OP_DUP", "OP_HASH160", "OP_DATA_20",
+		"OP_ELSE", "OP_DATA_3", "OP_CHECKLOCKTIMEVERIFY", "OP_DROP", "OP_DUP", "OP_HASH160", "OP_DATA_20",
+		"OP_ENDIF", "OP_EQUALVERIFY", "OP_CHECKSIG",
+	},
+}
+
+func type1aCandidate(secret string) (processedCandidate) {
+	hash := strings.Repeat("11", 32)
+	fee := 0.0002
+	
+	selector := "1"
+	if secret == "" {
+		selector = "0"
+	}
+	
+	return processedCandidate{
+		Block: 700000,
+		BlockHash: strings.Repeat("0b", 32),
+		Timestamp: "2021-09-07 07:00:00",
+		Transaction: "aa",
+		Version: 2,
+		LockTime: 699990,
+		Fee: &fee,
+		VSize: 237,
+		InputIndex: 1,
+		Sequence: 0xfffffffd,
+		InputTx: "bb",
+		InputVout: 7,
+		InputValue: 0.001,
+		PrevScript: "0020" + strings.Repeat("44", 32),
+		Asm: []string{"3045", "02", secret, selector, "63a820"},
+		SpendType: "p2wsh",
+		Family: "htlc",
+		Funding: "cc",
+		Replayed: true,
+		Ops: []string{
+			"OP_IF", "OP_SHA256", "OP_DATA_32 " + hash, "OP_EQUALVERIFY", "OP_DUP", "OP_HASH160", "OP_DATA_20 " + strings.Repeat("22", 20),
+			"OP_ELSE", "OP_DATA_3 a08601", "OP_CHECKLOCKTIMEVERIFY", "OP_DROP", "OP_DUP", "OP_HASH160", "OP_DATA_20 " + strings.Repeat("33", 20),
+			"OP_ENDIF", "OP_EQUALVERIFY", "OP_CHECKSIG",
+		},
+	}
+}
+
+func TestExtractData(t *testing.T) {
+	PC := type1aCandidate(strings.Repeat("55", 32))
+	
+	got, err := extractData(PC, []filteredHTLCType{type1a}, &registry.Chain{Name: "BTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	want := &htlc{
+		Chain: "btc",
+		Block: 700000,
+		BlockHash: PC.BlockHash,
+		Timestamp: PC.Timestamp,
+		Transaction: "aa",
+		Version: 2,
+		LockTime: 699990,
+		Fee: PC.Fee,
+		VSize: 237,
+		InputIndex: 1,
+		Sequence: 0xfffffffd,
+		InputTx: "bb",
+		InputVout: 7,
+		InputValue: 0.001,
+		PrevScript: PC.PrevScript,
+		SpendType: "p2wsh",
+		Family: "htlc",
+		Funding: "cc",
+		Replayed: true,
+		Type: "Type1a",
+		Timelock: "a08601",
+		PubKeys1: []string{strings.Repeat("22", 20)},
+		PubKey2: strings.Repeat("33", 20),
+		Secrets: []string{strings.Repeat("55", 32)},
+		SecretHashes: []string{strings.Repeat("11", 32)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+	
+	// the refund branch has no secret
+	if got, err = extractData(type1aCandidate(""), []filteredHTLCType{type1a}, &registry.Chain{Name: "BTC"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Secrets, []string{"none"}) {
+		t.Errorf("got secrets %v of a refund", got.Secrets)
+	}
+}
+
+func TestExtractDataOpcodes(t *testing.T) {
+	// decred hashes with OP_BLAKE256 where bitcoin has OP_SHA256
+	dcr := &registry.Chain{Name: "DCR", Opcodes: map[string]string{"OP_SHA256": "OP_BLAKE256"}}
+	
+	if _, err := extractData(type1aCandidate("55"), []filteredHTLCType{type1a}, dcr); err == nil {
+		t.Errorf("a blake256 HTLC has the type of a sha256 HTLC")
+	}
+}
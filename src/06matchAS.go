@@ -5,25 +5,59 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"math"
+	"os"
 	"runtime"
 	"runtime/debug"
 	"time"
+	
+	"detect-atomic-swaps/logging"
+	"detect-atomic-swaps/registry"
+)
 
-	"github.com/echa/btcutil/log"
-
-	// auto-register all available blockchain params
-	_ "github.com/echa/btcutil/wire/params"
+var (
+	log        = logging.New("HTLC")
+	flags      = flag.NewFlagSet("match", flag.ContinueOnError)
+	chainsFile string
 )
 
+func init() {
+	flags.Usage = func() {}
+	flags.StringVar(&chainsFile, "chains", "chains.json", "chain registry")
+}
+
 type htlc struct {
 	Chain        string   `json:"chain"`
 	Block        int64    `json:"block"`
+	BlockHash    string   `json:"block_hash"`
 	Timestamp    string   `json:"timestamp"`
 	Transaction  string   `json:"transaction"`
+	Version      int32    `json:"version"`
+	LockTime     uint32   `json:"lock_time"`
+	Fee          *float64 `json:"fee,omitempty"`
+	VSize        int64    `json:"vsize"`
+	Expiry       uint32   `json:"expiry,omitempty"`
+	Tree         int8     `json:"tree,omitempty"`
+	InputIndex   int      `json:"input_index"`
+	Sequence     uint32   `json:"sequence"`
 	InputTx      string   `json:"input_tx"`
+	InputVout    uint32   `json:"input_vout"`
 	InputValue   float64  `json:"input_value"`
+	Asset        string   `json:"asset,omitempty"`
+	Blinded      bool     `json:"blinded,omitempty"`
+	PrevScript   string   `json:"prev_script"`
+	SpendType    string   `json:"spend_type"`
+	Family       string   `json:"family"`
+	Refund       bool     `json:"refund,omitempty"`
+	Funding      string   `json:"funding,omitempty"`
+	// the transaction is also in the HTLCs of the parent or a forked chain
+	Replayed     bool     `json:"replayed,omitempty"`
+	LeafVersion  int      `json:"leaf_version,omitempty"`
+	InternalKey  string   `json:"internal_key,omitempty"`
+	MerklePath   []string `json:"merkle_path,omitempty"`
 	Type         string   `json:"type"`
 	Timelock     string   `json:"timelock"`
 	PubKeys1     []string `json:"pub_key_hashes1"`
@@ -47,160 +81,98 @@ type AtomicSwap struct {
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
-
+	
 	// Block and transaction processing can cause bursty allocations.  This
 	// limits the garbage collector from excessively overallocating during
 	// bursts.  This value was arrived at with the help of profiling live
 	// usage.
 	debug.SetGCPercent(20)
 	
-	// BTC
-	// read btc matches from file
-	rawBTC, err := ioutil.ReadFile("realHTLCsBTC.json")
-	if err != nil {
-        log.Fatal(err)
-    }
-	// create matches slice
-	var HTLCsBTC []htlc
-	// unmarshal json into matches slice
-	err = json.Unmarshal(rawBTC, &HTLCsBTC)
-	if err != nil {
-        log.Fatal(err)
-    }
-	
-	// LTC
-	// read ltc matches from file
-	rawLTC, err := ioutil.ReadFile("realHTLCsLTC.json")
-	if err != nil {
-        log.Fatal(err)
-    }
-	// create matches slice
-	var HTLCsLTC []htlc
-	// unmarshal json into matches slice
-	err = json.Unmarshal(rawLTC, &HTLCsLTC)
-	if err != nil {
-        log.Fatal(err)
-    }
-	
-	//BCH
-	// read bch matches from file
-	rawBCH, err := ioutil.ReadFile("realHTLCsBCH.json")
-	if err != nil {
-        log.Fatal(err)
-    }
-	// create matches slice
-	var HTLCsBCH []htlc
-	// unmarshal json into matches slice
-	err = json.Unmarshal(rawBCH, &HTLCsBCH)
-	if err != nil {
-        log.Fatal(err)
-    }
+	// parse command line flags
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Println("Atomic Swap Matching")
+			flags.PrintDefaults()
+			os.Exit(0)
+		}
+		log.Fatalf("Error: %v", err)
+	}
 	
-	// DCR
-	// read dcr matches from file
-	rawDCR, err := ioutil.ReadFile("realHTLCsDCR.json")
+	// for all blockchains in the registry
+	chains, err := registry.Read(chainsFile)
 	if err != nil {
-        log.Fatal(err)
-    }
-	// create matches slice
-	var HTLCsDCR []htlc
-	// unmarshal json into matches slice
-	err = json.Unmarshal(rawDCR, &HTLCsDCR)
-	if err != nil {
-        log.Fatal(err)
-    }
-	
-	thisHTLC := new(ProcessingHTLC)
-	var pmBTC []ProcessingHTLC
-	
-	// initialize processingMatches from loaded matches (BTC)
-	for _, currentHTLC := range(HTLCsBTC) {
-		*thisHTLC = ProcessingHTLC{
-			ThisHTLC: currentHTLC,
-			Processed: false,
-		}
-		
-		pmBTC = append(pmBTC, *thisHTLC)
+		log.Fatal(err)
 	}
 	
-	var pmLTC []ProcessingHTLC
+	// the processing matches of each chain
+	pms := make([][]ProcessingHTLC, len(chains))
 	
-	// initialize processingMatches from loaded matches (LTC)
-	for _, currentHTLC := range(HTLCsLTC) {
-		*thisHTLC = ProcessingHTLC{
-			ThisHTLC: currentHTLC,
-			Processed: false,
+	for i, c := range chains {
+		// read the matches of this chain from file
+		jsonFileName := c.File("htlcs")
+		raw, err := ioutil.ReadFile(jsonFileName)
+		if os.IsNotExist(err) {
+			log.Infof("skipping %s, %s does not exist", c.Name, jsonFileName)
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		// create matches slice
+		var htlcs []htlc
+		// unmarshal json into matches slice
+		err = json.Unmarshal(raw, &htlcs)
+		if err != nil {
+			log.Fatal(err)
 		}
 		
-		pmLTC = append(pmLTC, *thisHTLC)
+		// initialize processingMatches from loaded matches
+		for _, currentHTLC := range(htlcs) {
+			pms[i] = append(pms[i], ProcessingHTLC{
+				ThisHTLC: currentHTLC,
+				Processed: false,
+			})
+		}
 	}
 	
-	var pmBCH []ProcessingHTLC
+	AS, err := matchSwaps(chains, pms)
+	if err != nil {
+		log.Fatal(err)
+	}
 	
-	// initialize processingMatches from loaded matches (BCH)
-	for _, currentHTLC := range(HTLCsBCH) {
-		*thisHTLC = ProcessingHTLC{
-			ThisHTLC: currentHTLC,
-			Processed: false,
-		}
-		
-		pmBCH = append(pmBCH, *thisHTLC)
+	ASjson, err := json.MarshalIndent(AS, "", "\t")
+	if err != nil {
+		log.Fatal(err)
 	}
 	
-	var pmDCR []ProcessingHTLC
+	err = ioutil.WriteFile("AS.json", ASjson, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
 	
-	// initialize processingMatches from loaded matches (DCR)
-	for _, currentHTLC := range(HTLCsDCR) {
-		*thisHTLC = ProcessingHTLC{
-			ThisHTLC: currentHTLC,
-			Processed: false,
+	log.Infof("All done.")
+}
+
+// matchSwaps pairs the HTLCs of every chain with the ones of every chain after it which have the same
+// secret hashes and were mined within a day
+func matchSwaps(chains []*registry.Chain, pms [][]ProcessingHTLC) ([]AtomicSwap, error) {
+	// match every chain with every chain after it
+	var pairs [][2]int
+	for i := range chains {
+		for j := i + 1; j < len(chains); j++ {
+			pairs = append(pairs, [2]int{i, j})
 		}
-		
-		pmDCR = append(pmDCR, *thisHTLC)
 	}
 	
 	var AS []AtomicSwap
 	thisAS := new(AtomicSwap)
 	
-	for i := 0; i < 6; i++ {
-		
-		var pmChain1 []ProcessingHTLC
-		var pmChain2 []ProcessingHTLC
-		chain1 := ""
-		chain2 := ""
+	for _, pair := range pairs {
 		
-		switch i {
-			case 0:
-				pmChain1 = pmBTC
-				pmChain2 = pmLTC
-				chain1 = "BTC"
-				chain2 = "LTC"
-			case 1:
-				pmChain1 = pmBTC
-				pmChain2 = pmBCH
-				chain1 = "BTC"
-				chain2 = "BCH"
-			case 2:
-				pmChain1 = pmBTC
-				pmChain2 = pmDCR
-				chain1 = "BTC"
-				chain2 = "DCR"
-			case 3:
-				pmChain1 = pmLTC
-				pmChain2 = pmBCH
-				chain1 = "LTC"
-				chain2 = "BCH"
-			case 4:
-				pmChain1 = pmLTC
-				pmChain2 = pmDCR
-				chain1 = "LTC"
-				chain2 = "DCR"
-			case 5:
-				pmChain1 = pmBCH
-				pmChain2 = pmDCR
-				chain1 = "BCH"
-				chain2 = "DCR"
-		}
+		pmChain1 := pms[pair[0]]
+		pmChain2 := pms[pair[1]]
+		chain1 := chains[pair[0]].Name
+		chain2 := chains[pair[1]].Name
 		
 		// iterate over all matches in chain1
 		for _, currentHTLC1 := range(pmChain1) {
@@ -211,6 +183,11 @@ func main() {
 					matchFound := false
 					matchAndTime := false
 					
+					// a transaction replayed on a forked chain is no swap with itself
+					if currentHTLC1.ThisHTLC.Transaction == currentHTLC2.ThisHTLC.Transaction {
+						continue
+					}
+					
 					// if this match has not been processed yet
 					if currentHTLC2.Processed == false {
 						// check length of the secrethashes slice
@@ -218,7 +195,7 @@ func main() {
 							if currentHTLC1.ThisHTLC.SecretHashes[0] == currentHTLC2.ThisHTLC.SecretHashes[0] {
 								matchFound = true
 							}
-						} else { // multiple secrethashes
+						} else if len(currentHTLC1.ThisHTLC.SecretHashes) == len(currentHTLC2.ThisHTLC.SecretHashes) { // multiple secrethashes
 							for i, thisSecretHash := range(currentHTLC1.ThisHTLC.SecretHashes) {
 								if thisSecretHash == currentHTLC2.ThisHTLC.SecretHashes[i] {
 									matchFound = true
@@ -235,11 +212,11 @@ func main() {
 							timelayout := "2006-01-02 15:04:05 -0700 UTC"
 							time1, err := time.Parse(timelayout, currentHTLC1.ThisHTLC.Timestamp)
 							if err != nil {
-								log.Fatal(err)
+								return nil, err
 							}
 							time2, err := time.Parse(timelayout, currentHTLC2.ThisHTLC.Timestamp)
 							if err != nil {
-								log.Fatal(err)
+								return nil, err
 							}
 							
 							// and check if they are close enough to each other (less then one day)
@@ -271,15 +248,5 @@ func main() {
 		}
 	}
 	
-	ASjson, err := json.MarshalIndent(AS, "", "\t")
-	if err != nil {
-		log.Fatal(err)
-	}
-	
-	err = ioutil.WriteFile("AS.json", ASjson, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	
-	log.Infof("All done.")
-}
\ No newline at end of file
+	return AS, nil
+}
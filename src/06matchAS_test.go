@@ -0,0 +1,78 @@
+// Copyright (c) 2018 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+// The tests of the matching are run with
+// go test 06matchAS.go 06matchAS_test.go
+
+package main
+
+import (
+	"testing"
+	
+	"detect-atomic-swaps/registry"
+)
+
+func processing(htlcs ...htlc) ([]ProcessingHTLC) {
+	var pms []ProcessingHTLC
+	for _, h := range htlcs {
+		pms = append(pms, ProcessingHTLC{ThisHTLC: h})
+	}
+	return pms
+}
+
+func TestMatchSwaps(t *testing.T) {
+	chains := []*registry.Chain{{Name: "BTC"}, {Name: "BCH"}, {Name: "LTC"}}
+	
+	pms := [][]ProcessingHTLC{
+		processing(
+			htlc{Transaction: "aa", Timestamp: "2017-08-02 10:00:00 +0000 UTC", SecretHashes: []string{"11"}},
+			htlc{Transaction: "bb", Timestamp: "2017-08-02 10:00:00 +0000 UTC", SecretHashes: []string{"22"}},
+		),
+		// aa was replayed on BCH after the fork, dd is the counterpart of bb
+		processing(
+			htlc{Transaction: "aa", Timestamp: "2017-08-02 10:00:00 +0000 UTC", SecretHashes: []string{"11"}},
+			htlc{Transaction: "dd", Timestamp: "2017-08-02 12:00:00 +0000 UTC", SecretHashes: []string{"22"}},
+		),
+		// ee has the secret hash of aa but was mined two days later
+		processing(
+			htlc{Transaction: "ee", Timestamp: "2017-08-04 10:00:00 +0000 UTC", SecretHashes: []string{"11"}},
+		),
+	}
+	
+	AS, err := matchSwaps(chains, pms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(AS) != 1 {
+		t.Fatalf("got %d swaps, want 1: %+v", len(AS), AS)
+	}
+	if AS[0].Chain1 != "BTC" || AS[0].HTLC1.Transaction != "bb" || AS[0].Chain2 != "BCH" || AS[0].HTLC2.Transaction != "dd" {
+		t.Errorf("got swap %s %s with %s %s, want BTC bb with BCH dd", AS[0].Chain1, AS[0].HTLC1.Transaction, AS[0].Chain2, AS[0].HTLC2.Transaction)
+	}
+}
+
+func TestMatchSwapsSameTransaction(t *testing.T) {
+	chains := []*registry.Chain{{Name: "BTC"}, {Name: "BCH"}}
+	
+	// the same transaction on both sides of the fork is no swap, even though secret hashes and times match
+	h := htlc{Transaction: "aa", Timestamp: "2017-08-02 10:00:00 +0000 UTC", SecretHashes: []string{"11", "22"}}
+	pms := [][]ProcessingHTLC{processing(h), processing(h)}
+	
+	AS, err := matchSwaps(chains, pms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(AS) != 0 {
+		t.Errorf("got swaps %+v of a transaction with itself", AS)
+	}
+	
+	// another transaction with the same secret hashes is
+	h.Transaction = "bb"
+	pms[1] = processing(h)
+	if AS, err = matchSwaps(chains, pms); err != nil {
+		t.Fatal(err)
+	}
+	if len(AS) != 1 {
+		t.Errorf("got %d swaps, want 1", len(AS))
+	}
+}
@@ -0,0 +1,33 @@
+// Author: dominik.lauck@mailbox.tu-dresden.de
+// 
+// Package logging has the loggers of the stages, which all write to stdout.
+
+package logging
+
+import (
+	"os"
+	
+	"github.com/btcsuite/btclog"
+)
+
+var backend = btclog.NewBackend(os.Stdout)
+
+// Logger wraps a btclog.Logger with the Fatal helpers used throughout the scripts.
+type Logger struct {
+	btclog.Logger
+}
+
+// New returns the logger of a subsystem, e.g. HTLC for the messages of a stage or JRPC for the RPC client
+func New(subsystem string) Logger {
+	return Logger{backend.Logger(subsystem)}
+}
+
+func (l Logger) Fatal(v ...interface{}) {
+	l.Critical(v...)
+	os.Exit(1)
+}
+
+func (l Logger) Fatalf(format string, v ...interface{}) {
+	l.Criticalf(format, v...)
+	os.Exit(1)
+}
@@ -0,0 +1,117 @@
+// Author: dominik.lauck@mailbox.tu-dresden.de
+// 
+// Package registry reads the chain registry (chains.json), which describes the blockchains every stage works on.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Chain describes a blockchain in the chain registry
+type Chain struct {
+	// short name used in the file names and in the matches, e.g. BTC
+	Name        string            `json:"name"`
+	// other names accepted by -chain, the name itself is accepted in any case
+	Aliases     []string          `json:"aliases"`
+	// name of the chain params in the btcutil library, e.g. bitcoin
+	Params      string            `json:"params"`
+	// serialization of blocks and transactions, bitcoin for the format of bitcoin core,
+	// empty if the blocks can not be decoded locally
+	Wire        string            `json:"wire"`
+	// first block which may contain HTLCs
+	LowestBlock int64             `json:"lowest_block"`
+	// the chain this chain was forked from, nil if it has its own history
+	Fork        *Fork             `json:"fork"`
+	RPC         RPC               `json:"rpc"`
+	// opcodes which have a different meaning on this chain, renamed to the name used for other chains
+	Opcodes     map[string]string `json:"opcodes"`
+	// opcodes starting the scriptSig of inputs which take value out of a pool instead of spending an output,
+	// e.g. the sigma and lelantus spends of zcoin
+	PoolSpends  []string          `json:"pool_spends"`
+	// file names which differ from the default ones, by kind (see DefaultFiles)
+	Files       map[string]string `json:"files"`
+}
+
+// Fork tells where a chain split off its parent. The blocks below Height are shared with the parent
+// and belong to it.
+type Fork struct {
+	// name of the parent chain in the registry
+	Parent string `json:"parent"`
+	// first block which is not part of the parent chain
+	Height int64  `json:"height"`
+}
+
+// RPC are the defaults to talk to the node of a chain
+type RPC struct {
+	Port     string `json:"port"`
+	// dcrd for decred nodes, bitcoind for everything else
+	API      string `json:"api"`
+	TLS      bool   `json:"tls"`
+	// certificate of the node, only used with tls
+	Cert     string `json:"cert"`
+	// verbosity (the default) if getblock takes a verbosity, bool if it only knows verbose true or false
+	// (e.g. dogecoin and zcoin), these nodes can not return the transactions with the block
+	GetBlock string `json:"getblock"`
+}
+
+// DefaultFiles are the file names of each stage, %s is replaced by the name of the chain
+var DefaultFiles = map[string]string{
+	"block":      "block%s.txt",
+	"checkpoint": "checkpoint%s.json",
+	"candidates": "HTLCs%s.json",
+	"processed":  "pHTLCs%s.json",
+	"filtered":   "filteredHTLCs%s.json",
+	"htlcs":      "realHTLCs%s.json",
+	"mempool":    "mempoolHTLCs%s.json",
+	"lightning":  "lightningHTLCs%s.json",
+}
+
+// File returns the name of the file of the given kind for this chain
+func (c *Chain) File(kind string) string {
+	if fileName, ok := c.Files[kind]; ok {
+		return fileName
+	}
+	
+	return fmt.Sprintf(DefaultFiles[kind], c.Name)
+}
+
+// Read reads the chain registry
+func Read(fileName string) ([]*Chain, error) {
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	
+	var chains []*Chain
+	if err := json.Unmarshal(raw, &chains); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	
+	for _, c := range chains {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s: chain without name", fileName)
+		}
+	}
+	
+	return chains, nil
+}
+
+// Find returns the chain with the given name or alias
+func Find(chains []*Chain, name string) *Chain {
+	for _, c := range chains {
+		if strings.EqualFold(c.Name, name) {
+			return c
+		}
+		for _, alias := range c.Aliases {
+			if strings.EqualFold(alias, name) {
+				return c
+			}
+		}
+	}
+	
+	return nil
+}
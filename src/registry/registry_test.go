@@ -0,0 +1,150 @@
+// Author: dominik.lauck@mailbox.tu-dresden.de
+// 
+// The tests are run with go test in this directory, the last one reads the registry of the stages (../chains.json).
+
+package registry
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRegistry(t *testing.T, raw string) string {
+	t.Helper()
+	
+	fileName := filepath.Join(t.TempDir(), "chains.json")
+	if err := ioutil.WriteFile(fileName, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	return fileName
+}
+
+func TestRead(t *testing.T) {
+	chains, err := Read(writeRegistry(t, `[
+		{"name": "BTC", "aliases": ["bitcoin"], "lowest_block": 200000, "rpc": {"port": "8332"}},
+		{"name": "BCH", "wire": "bitcoin", "fork": {"parent": "BTC", "height": 478559}, "rpc": {"port": "8332", "getblock": "bool"}},
+		{"name": "DCR", "rpc": {"port": "9109", "api": "dcrd", "tls": true, "cert": "rpc.cert"}, "opcodes": {"OP_SHA256": "OP_UNKNOWN192"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	if len(chains) != 3 {
+		t.Fatalf("got %d chains, want 3", len(chains))
+	}
+	if c := chains[0]; c.Name != "BTC" || len(c.Aliases) != 1 || c.LowestBlock != 200000 || c.Fork != nil || c.RPC.Port != "8332" {
+		t.Errorf("got %+v", c)
+	}
+	if c := chains[1]; c.Wire != "bitcoin" || c.Fork == nil || c.Fork.Parent != "BTC" || c.Fork.Height != 478559 || c.RPC.GetBlock != "bool" {
+		t.Errorf("got %+v", c)
+	}
+	if c := chains[2]; c.RPC.API != "dcrd" || !c.RPC.TLS || c.RPC.Cert != "rpc.cert" || c.Opcodes["OP_SHA256"] != "OP_UNKNOWN192" {
+		t.Errorf("got %+v", c)
+	}
+	
+	for _, test := range []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{"chain without name", `[{"name": "BTC"}, {"aliases": ["litecoin"]}]`, "chain without name"},
+		{"invalid json", `[{"name": "BTC"`, "chains.json"},
+		{"no list", `{"name": "BTC"}`, "chains.json"},
+	} {
+		if _, err := Read(writeRegistry(t, test.raw)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+	
+	if _, err := Read(filepath.Join(t.TempDir(), "chains.json")); err == nil {
+		t.Error("read a missing registry")
+	}
+}
+
+func TestFind(t *testing.T) {
+	chains := []*Chain{
+		{Name: "BTC", Aliases: []string{"bitcoin"}},
+		{Name: "BCH", Aliases: []string{"bitcoincash", "bcash"}},
+		{Name: "DCR", Aliases: []string{"decred"}},
+	}
+	
+	tests := []struct {
+		name  string
+		chain string
+	}{
+		{"BTC", "BTC"},
+		{"btc", "BTC"},
+		{"Bitcoin", "BTC"},
+		{"bcash", "BCH"},
+		{"BCASH", "BCH"},
+		{"bch", "BCH"},
+		{"Decred", "DCR"},
+		// names are not prefixes
+		{"BT", ""},
+		{"bitcoin cash", ""},
+		{"", ""},
+	}
+	
+	for _, test := range tests {
+		c := Find(chains, test.name)
+		switch {
+		case test.chain == "" && c != nil:
+			t.Errorf("%q: got %s", test.name, c.Name)
+		case test.chain != "" && (c == nil || c.Name != test.chain):
+			t.Errorf("%q: got %+v, want %s", test.name, c, test.chain)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	c := &Chain{Name: "LTC", Files: map[string]string{"candidates": "/data/litecoin/HTLCs.json", "block": "blockLTC.old"}}
+	
+	tests := []struct {
+		kind     string
+		fileName string
+	}{
+		{"candidates", "/data/litecoin/HTLCs.json"},
+		{"block", "blockLTC.old"},
+		{"checkpoint", "checkpointLTC.json"},
+		{"processed", "pHTLCsLTC.json"},
+		{"filtered", "filteredHTLCsLTC.json"},
+		{"htlcs", "realHTLCsLTC.json"},
+		{"mempool", "mempoolHTLCsLTC.json"},
+		{"lightning", "lightningHTLCsLTC.json"},
+	}
+	
+	for _, test := range tests {
+		if fileName := c.File(test.kind); fileName != test.fileName {
+			t.Errorf("%s: got %s, want %s", test.kind, fileName, test.fileName)
+		}
+	}
+	
+	// every kind has a default
+	for kind := range DefaultFiles {
+		if fileName := (&Chain{Name: "BTC"}).File(kind); !strings.Contains(fileName, "BTC") {
+			t.Errorf("%s: got %s", kind, fileName)
+		}
+	}
+}
+
+func TestRegistryOfTheStages(t *testing.T) {
+	chains, err := Read(filepath.Join("..", "chains.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// every name and alias finds its own chain
+	for _, c := range chains {
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			if found := Find(chains, name); found != c {
+				t.Errorf("%s finds %+v instead of %s", name, found, c.Name)
+			}
+		}
+		if c.Fork != nil && Find(chains, c.Fork.Parent) == nil {
+			t.Errorf("parent %s of %s is not in the registry", c.Fork.Parent, c.Name)
+		}
+	}
+}